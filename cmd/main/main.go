@@ -6,7 +6,10 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"runtime"
 	"runtime/pprof"
+	"strings"
+	"sync"
 	"time"
 
 	"seg-layout/segment"
@@ -16,17 +19,23 @@ const (
 	TiB            = 1024 * 1024 * 1024 * 1024
 	MaxRequestSize = 4 * 1024 * 1024
 	MinRequestSize = 512
+
+	// Live allocations each parallel benchmark worker keeps at most
+	parallelLiveAllocations = 64
 )
 
 // Debug mode flag
 var debugMode = flag.Bool("debug", false, "Enable debug mode")
 
 type TestConfig struct {
+	allocator       string  // Name of the allocator to test
 	deleteRatio     float64 // Ratio of delete operations
 	maxRequestSize  int64   // Maximum request size in bytes
 	minRequestSize  int64   // Minimum request size in bytes
 	totalOperations int     // Total number of operations to perform
 	targetWriteSize uint64  // Target total write size for endurance test (in bytes)
+	maxExtents      int     // Maximum extents per vectored allocation, 0 disables them
+	pageSize        uint32  // Minimum allocation unit in bytes
 }
 
 type TestResult struct {
@@ -38,6 +47,7 @@ type TestResult struct {
 	operations      int           // Number of operations performed
 	allocSuccess    int           // Number of successful allocations
 	deleteSuccess   int           // Number of successful deletions
+	vectorSuccess   int           // Number of allocations split across extents
 	duration        time.Duration // Test duration
 }
 
@@ -47,13 +57,30 @@ func generateRequest(config TestConfig) int64 {
 	return (size + 511) & ^511 // Round up to nearest 512 bytes
 }
 
+// newSegment creates a 1 TiB segment backed by the configured allocator
+func newSegment(config TestConfig) (*segment.Segment, error) {
+	allocator, err := segment.NewAllocator(config.allocator)
+	if err != nil {
+		return nil, err
+	}
+	seg, err := segment.NewSegmentWithConfig(segment.SegmentConfig{
+		Size:      uint64(TiB),
+		PageSize:  config.pageSize,
+		Allocator: allocator,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create segment: %v", err)
+	}
+	return seg, nil
+}
+
 // runTest executes the allocation test with given configuration
 func runTest(config TestConfig) (*TestResult, error) {
 	startTime := time.Now()
 	// Initialize segment with 1 TiB space
-	seg, err := segment.NewSegment(uint64(TiB))
+	seg, err := newSegment(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create segment: %v", err)
+		return nil, err
 	}
 	result := &TestResult{
 		totalSpace: uint64(TiB),
@@ -96,11 +123,9 @@ func runTest(config TestConfig) (*TestResult, error) {
 				return result, err
 			}
 
-			if res != nil && res.Success {
-				allocations[res.Offset] = res.Size
-				result.allocSuccess++
-				result.totalDataSize += uint64(size)
-			}
+			allocations[res.Offset] = res.Size
+			result.allocSuccess++
+			result.totalDataSize += uint64(size)
 		}
 		result.operations++
 	}
@@ -113,9 +138,9 @@ func runEnduranceTest(config TestConfig) (*TestResult, error) {
 	startTime := time.Now()
 
 	// Initialize segment with 1 TiB space
-	seg, err := segment.NewSegment(uint64(TiB))
+	seg, err := newSegment(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create segment: %v", err)
+		return nil, err
 	}
 
 	result := &TestResult{
@@ -152,10 +177,25 @@ func runEnduranceTest(config TestConfig) (*TestResult, error) {
 
 			size := generateRequest(config)
 			res, err := seg.Allocate(uint64(size))
-			if err != nil || !res.Success {
+			if err != nil && config.maxExtents > 0 {
+				// Fall back to writing the block across several extents
+				vec, vecErr := seg.AllocateVector(uint64(size), config.maxExtents, uint64(config.minRequestSize))
+				if vecErr == nil {
+					writeFailCount = 0
+					for _, ext := range vec.Extents {
+						allocations[ext.Offset] = ext.Size
+					}
+					result.allocSuccess++
+					result.vectorSuccess++
+					totalWritten += uint64(size)
+					result.totalDataSize += uint64(size)
+					continue
+				}
+			}
+			if err != nil {
 				writeFailCount++
 				if writeFailCount >= maxConsecutiveFails {
-					log.Printf("Write failed %d times consecutively\n", writeFailCount)
+					log.Printf("Write failed %d times consecutively: %v\n", writeFailCount, err)
 				}
 				continue
 			}
@@ -170,6 +210,7 @@ func runEnduranceTest(config TestConfig) (*TestResult, error) {
 		// Record disk utilization at "full" state
 		fullUtilization := seg.GetUtilization()
 		log.Printf("Disk utilization when full: %.2f%%\n", fullUtilization*100)
+		log.Printf("Fragmentation when full: %v\n", seg.GetFragmentation())
 
 		// Phase 2: Random deletion (30-50%)
 		if len(allocations) > 0 {
@@ -225,6 +266,123 @@ func runEnduranceTest(config TestConfig) (*TestResult, error) {
 	return result, nil
 }
 
+// runAllocBenchmark measures Allocate/Free latency of the configured
+// allocator for a few request sizes on a pre-fragmented 1 TiB space
+func runAllocBenchmark(config TestConfig) error {
+	const benchIterations = 10000
+
+	allocator, err := segment.NewAllocator(config.allocator)
+	if err != nil {
+		return err
+	}
+	allocator.Init(uint64(TiB), 4096)
+
+	// Fragment the space with a random mix of allocations and deletions
+	var offsets []uint64
+	sizes := make(map[uint64]uint64)
+	for i := 0; i < config.totalOperations; i++ {
+		if rand.Float64() < config.deleteRatio && len(offsets) > 0 {
+			idx := rand.Intn(len(offsets))
+			offset := offsets[idx]
+			if err := allocator.Free(offset, sizes[offset]); err != nil {
+				return err
+			}
+			delete(sizes, offset)
+			offsets[idx] = offsets[len(offsets)-1]
+			offsets = offsets[:len(offsets)-1]
+			continue
+		}
+		res, err := allocator.Allocate(uint64(generateRequest(config)))
+		if err == nil {
+			offsets = append(offsets, res.Offset)
+			sizes[res.Offset] = res.Size
+		}
+	}
+	log.Printf("Fragmented to %.2f%% utilization with %d live allocations\n",
+		allocator.GetUtilization()*100, len(offsets))
+
+	for _, size := range []uint64{4 << 10, 64 << 10, 1 << 20, 4 << 20} {
+		startTime := time.Now()
+		for i := 0; i < benchIterations; i++ {
+			res, err := allocator.Allocate(size)
+			if err != nil {
+				return fmt.Errorf("failed to allocate %d bytes: %w", size, err)
+			}
+			if err := allocator.Free(res.Offset, res.Size); err != nil {
+				return err
+			}
+		}
+		elapsed := time.Since(startTime)
+		log.Printf("Allocate+Free %7d bytes: %v/op\n", size, elapsed/benchIterations)
+	}
+	return nil
+}
+
+// runParallelBenchmark measures Allocate/Free throughput of the configured
+// allocator with 1, 2, 4, ... up to maxWorkers concurrent workers. Each
+// worker performs config.totalOperations operations as its own stream.
+func runParallelBenchmark(config TestConfig, maxWorkers int) error {
+	for workers := 1; ; workers = min(workers*2, maxWorkers) {
+		allocator, err := segment.NewAllocator(config.allocator)
+		if err != nil {
+			return err
+		}
+		allocator.Init(uint64(TiB), 4096)
+		streams, _ := allocator.(segment.StreamAllocator)
+
+		errs := make(chan error, workers)
+		var wg sync.WaitGroup
+		startTime := time.Now()
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(stream uint64) {
+				defer wg.Done()
+				var live []segment.Extent
+				for i := 0; i < config.totalOperations; i++ {
+					if len(live) > 0 && (len(live) >= parallelLiveAllocations || rand.Float64() < config.deleteRatio) {
+						idx := rand.Intn(len(live))
+						ext := live[idx]
+						live[idx] = live[len(live)-1]
+						live = live[:len(live)-1]
+						if err := allocator.Free(ext.Offset, ext.Size); err != nil {
+							errs <- err
+							return
+						}
+						continue
+					}
+
+					size := uint64(generateRequest(config))
+					var res *segment.Result
+					var err error
+					if streams != nil {
+						res, err = streams.AllocateStream(stream, size)
+					} else {
+						res, err = allocator.Allocate(size)
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+					live = append(live, segment.Extent{Offset: res.Offset, Size: res.Size})
+				}
+			}(uint64(w))
+		}
+		wg.Wait()
+		elapsed := time.Since(startTime)
+		close(errs)
+		if err := <-errs; err != nil {
+			return err
+		}
+
+		ops := workers * config.totalOperations
+		log.Printf("%3d workers: %d ops in %v, %.0f ops/s\n",
+			workers, ops, elapsed, float64(ops)/elapsed.Seconds())
+		if workers == maxWorkers {
+			return nil
+		}
+	}
+}
+
 func main() {
 	// Parse command line flags
 	deleteRatio := flag.Float64("delete-ratio", 0.3, "Ratio of delete operations (0.0-1.0)")
@@ -232,7 +390,11 @@ func main() {
 	minSize := flag.Int64("min-size", MinRequestSize, "Minimum request size in bytes")
 	operations := flag.Int("operations", 1000, "Number of operations to perform")
 	targetWrite := flag.Uint64("target-write", 10*TiB, "Target total write size for endurance test")
-	testMode := flag.String("mode", "normal", "Test mode: normal or endurance")
+	maxExtents := flag.Int("max-extents", 0, "Split endurance writes across up to this many extents when no contiguous space is left (0 disables)")
+	pageSize := flag.Uint("page-size", 4096, "Minimum allocation unit in bytes (power of two, multiple of 512)")
+	testMode := flag.String("mode", "normal", "Test mode: normal, endurance, bench or parallel")
+	workers := flag.Int("workers", runtime.GOMAXPROCS(0), "Maximum number of concurrent workers in parallel mode")
+	allocators := flag.String("allocator", segment.AllocatorBitmap, "Comma-separated allocators to benchmark: bitmap, extent-first-fit, extent-best-fit, hybrid, buddy, sharded")
 	cpuProfile := flag.String("cpuprofile", "", "write cpu profile to file")
 	memProfile := flag.String("memprofile", "", "write memory profile to file")
 	flag.Parse()
@@ -271,37 +433,66 @@ func main() {
 		return
 	}
 
-	// Configure test
-	config := TestConfig{
-		deleteRatio:     *deleteRatio,
-		maxRequestSize:  *maxSize,
-		minRequestSize:  *minSize,
-		totalOperations: *operations,
-		targetWriteSize: *targetWrite,
+	if *workers < 1 {
+		log.Println("Workers must be at least 1")
+		return
 	}
 
-	var result *TestResult
-	var err error
+	// Run the test once for each allocator
+	for _, name := range strings.Split(*allocators, ",") {
+		// Configure test
+		config := TestConfig{
+			allocator:       strings.TrimSpace(name),
+			deleteRatio:     *deleteRatio,
+			maxRequestSize:  *maxSize,
+			minRequestSize:  *minSize,
+			totalOperations: *operations,
+			targetWriteSize: *targetWrite,
+			maxExtents:      *maxExtents,
+			pageSize:        uint32(*pageSize),
+		}
 
-	// Run test based on mode
-	log.Printf("Starting %s test...\n", *testMode)
-	if *testMode == "endurance" {
-		result, err = runEnduranceTest(config)
-	} else {
-		result, err = runTest(config)
-	}
+		var result *TestResult
+		var err error
+
+		// Run test based on mode
+		log.Printf("Starting %s test with %s allocator...\n", *testMode, config.allocator)
+		if *testMode == "bench" {
+			if err := runAllocBenchmark(config); err != nil {
+				log.Printf("Test Error: %v\n", err)
+			}
+			continue
+		}
+		if *testMode == "parallel" {
+			if err := runParallelBenchmark(config, *workers); err != nil {
+				log.Printf("Test Error: %v\n", err)
+			}
+			continue
+		}
+		if *testMode == "endurance" {
+			result, err = runEnduranceTest(config)
+		} else {
+			result, err = runTest(config)
+		}
+		if result == nil {
+			log.Printf("Test Error: %v\n", err)
+			continue
+		}
 
-	// Print results
-	log.Println("\nTest Results:")
-	log.Printf("Test Error: %v\n", err)
-	log.Printf("Test Duration: %v\n", result.duration)
-	log.Printf("Total Operations: %d\n", result.operations)
-	log.Printf("Successful Allocations: %d\n", result.allocSuccess)
-	log.Printf("Successful Deletions: %d\n", result.deleteSuccess)
-	log.Printf("Total Data Written: %.2f TiB\n", float64(result.totalDataSize)/float64(TiB))
-	log.Printf("Used Space: %.2f GiB\n", float64(result.usedSpace)/float64(1024*1024*1024))
-	log.Printf("Disk Utilization: %.2f%%\n", result.diskUtilization*100)
-	log.Printf("Memory Usage: %.2f MiB\n", float64(result.memoryUsage)/float64(1024*1024))
+		// Print results
+		log.Println("\nTest Results:")
+		log.Printf("Allocator: %s\n", config.allocator)
+		log.Printf("Test Error: %v\n", err)
+		log.Printf("Test Duration: %v\n", result.duration)
+		log.Printf("Total Operations: %d\n", result.operations)
+		log.Printf("Successful Allocations: %d\n", result.allocSuccess)
+		log.Printf("Successful Deletions: %d\n", result.deleteSuccess)
+		log.Printf("Vectored Allocations: %d\n", result.vectorSuccess)
+		log.Printf("Total Data Written: %.2f TiB\n", float64(result.totalDataSize)/float64(TiB))
+		log.Printf("Used Space: %.2f GiB\n", float64(result.usedSpace)/float64(1024*1024*1024))
+		log.Printf("Disk Utilization: %.2f%%\n", result.diskUtilization*100)
+		log.Printf("Memory Usage: %.2f MiB\n", float64(result.memoryUsage)/float64(1024*1024))
+	}
 
 	// Write memory profile if requested
 	if *memProfile != "" {
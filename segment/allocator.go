@@ -0,0 +1,172 @@
+package segment
+
+import (
+	"fmt"
+	"io"
+)
+
+// Allocator is the space allocation contract shared by all allocator
+// implementations. Segment and Preallocator only depend on this interface.
+type Allocator interface {
+	// Init initializes the allocator to manage size bytes in units of pageSize
+	Init(size uint64, pageSize uint32)
+	// Allocate allocates space of the specified size. It fails with
+	// ErrZeroSize or a *SpaceError.
+	Allocate(size uint64) (*Result, error)
+	// Free releases allocated space. It fails with ErrMisaligned or
+	// ErrOutOfRange for invalid ranges and with ErrDoubleFree if any of the
+	// range is not allocated.
+	Free(offset, size uint64) error
+	// GetUtilization returns the current space utilization
+	GetUtilization() float64
+	// GetTotalAllocated returns the total allocated space
+	GetTotalAllocated() uint64
+	// GetMemoryUsage returns the memory usage of the allocator
+	GetMemoryUsage() uint64
+	// ForEachFreeExtent calls fn for each maximal free extent in offset
+	// order until fn returns false. fn runs with the allocator's lock held,
+	// so it must not call the allocator, and allocations and frees wait for
+	// it to return; callers that do more than collect or count extents
+	// should collect them first.
+	ForEachFreeExtent(fn func(offset, length uint64) bool)
+}
+
+// PersistentAllocator is an allocator whose state can be saved, checkpointed
+// and journaled
+type PersistentAllocator interface {
+	Allocator
+	Save(w io.Writer) error
+	Checkpoint(w io.Writer) error
+	SetJournal(j *Journal)
+}
+
+// HintAllocator is an allocator that can place an allocation near a hint
+type HintAllocator interface {
+	Allocator
+	// AllocateNear allocates space of the specified size at the free run
+	// nearest to hint, searching outward from it in both directions
+	AllocateNear(size, hint uint64) (*Result, error)
+}
+
+// VectorAllocator is an allocator that can satisfy a request with several
+// extents when no contiguous run is large enough
+type VectorAllocator interface {
+	Allocator
+	// AllocateVector allocates size bytes as up to maxExtents extents of at
+	// least minExtentSize bytes each, except possibly the last one
+	AllocateVector(size uint64, maxExtents int, minExtentSize uint64) (*VectorResult, error)
+}
+
+// AlignedAllocator is an allocator that can align allocations beyond the
+// page size
+type AlignedAllocator interface {
+	Allocator
+	// AllocateAligned allocates space of the specified size at an offset
+	// that is a multiple of align
+	AllocateAligned(size, align uint64) (*Result, error)
+}
+
+// ClaimAllocator is an allocator that can allocate an exact range, used to
+// rebuild allocation state from metadata that is already on disk
+type ClaimAllocator interface {
+	Allocator
+	// AllocateAt allocates the range starting at offset, failing with a
+	// *RangeAllocatedError if any of it is already allocated
+	AllocateAt(offset, size uint64) (*Result, error)
+}
+
+// ResizableAllocator is an allocator whose managed size can change while
+// it is in use
+type ResizableAllocator interface {
+	Allocator
+	// Resize grows or shrinks the managed space to newSize, preserving
+	// allocations. Shrinking fails with a *ShrinkBlockedError if any
+	// allocated space lies past newSize.
+	Resize(newSize uint64) error
+}
+
+// StreamAllocator is an allocator that keeps the allocations of one stream,
+// such as a writer or an open block file, together
+type StreamAllocator interface {
+	Allocator
+	// AllocateStream allocates space of the specified size for a stream
+	AllocateStream(stream, size uint64) (*Result, error)
+}
+
+// ReservingAllocator is an allocator with a journal that can set space aside
+// without journaling it, so that space held by the pre-allocator is free
+// again after a crash instead of being recovered as allocated
+type ReservingAllocator interface {
+	Allocator
+	// Reserve allocates space of the specified size at the free run
+	// nearest to hint without journaling it
+	Reserve(size, hint uint64) (*Result, error)
+	// Commit journals reserved space as allocated once it is handed out
+	Commit(offset, size uint64) error
+	// Uncommit journals allocated space as freed but keeps it allocated,
+	// turning it back into reserved space
+	Uncommit(offset, size uint64) error
+	// Unreserve frees reserved space that was never committed without
+	// journaling it
+	Unreserve(offset, size uint64) error
+}
+
+// GroupedAllocator is an allocator that splits its space into independent
+// allocation groups. An allocation never crosses a group boundary, and
+// neither may a freed range.
+type GroupedAllocator interface {
+	Allocator
+	// GroupSize returns the size of the allocation groups, which start at
+	// multiples of it
+	GroupSize() uint64
+}
+
+// Allocator names accepted by NewAllocator
+const (
+	AllocatorBitmap         = "bitmap"
+	AllocatorExtentFirstFit = "extent-first-fit"
+	AllocatorExtentBestFit  = "extent-best-fit"
+	AllocatorHybrid         = "hybrid"
+	AllocatorBuddy          = "buddy"
+	AllocatorSharded        = "sharded"
+)
+
+// NewAllocator creates an uninitialized allocator by name
+func NewAllocator(name string) (Allocator, error) {
+	switch name {
+	case AllocatorBitmap:
+		return NewBitmapAllocator(), nil
+	case AllocatorExtentFirstFit:
+		return NewExtentAllocator(FirstFit), nil
+	case AllocatorExtentBestFit:
+		return NewExtentAllocator(BestFit), nil
+	case AllocatorHybrid:
+		return NewHybridAllocator(defaultHybridBudget), nil
+	case AllocatorBuddy:
+		return NewBuddyAllocator(defaultBuddyMaxBlock), nil
+	case AllocatorSharded:
+		return NewShardedAllocator(0), nil
+	default:
+		return nil, fmt.Errorf("unknown allocator %q", name)
+	}
+}
+
+var (
+	_ PersistentAllocator = (*BitmapAllocator)(nil)
+	_ HintAllocator       = (*BitmapAllocator)(nil)
+	_ VectorAllocator     = (*BitmapAllocator)(nil)
+	_ AlignedAllocator    = (*BitmapAllocator)(nil)
+	_ ClaimAllocator      = (*BitmapAllocator)(nil)
+	_ ResizableAllocator  = (*BitmapAllocator)(nil)
+	_ ReservingAllocator  = (*BitmapAllocator)(nil)
+	_ Allocator           = (*ExtentAllocator)(nil)
+	_ Allocator           = (*HybridAllocator)(nil)
+	_ Allocator           = (*BuddyAllocator)(nil)
+	_ StreamAllocator     = (*ShardedAllocator)(nil)
+	_ GroupedAllocator    = (*ShardedAllocator)(nil)
+)
+
+// isPowerOfTwo reports whether x is a non-zero power of two
+func isPowerOfTwo(x uint64) bool {
+	return x != 0 && x&(x-1) == 0
+}
@@ -1,7 +1,10 @@
 package segment
 
 import (
+	"fmt"
+	"math/bits"
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -19,14 +22,24 @@ const (
 	maxDiskSize = 1 << 40 // 1 TiB (2^40)
 )
 
-// BitmapAllocator manages space allocation using a two-level bitmap
+// BitmapAllocator manages space allocation using a two-level bitmap. Level 0
+// has one bit per page; level 1 summarizes each unit set of eight level 0
+// words twice, once for "fully allocated" and once for "fully free", so that
+// searches can skip full regions and take free regions whole.
 type BitmapAllocator struct {
-	level0    []uint64 // Level 0 bitmap for individual blocks
-	level1    []uint64 // Level 1 bitmap for unit sets
-	totalSize uint64   // Total size of managed space
-	pageSize  uint32   // Size of each page
-	allocated uint64   // Total allocated space
-	mu        sync.RWMutex
+	level0     []uint64                // Level 0 bitmap for individual blocks
+	level1     []uint64                // Level 1 bitmap, set when a unit set is fully allocated
+	level1Free []uint64                // Level 1 bitmap, set when a unit set is fully free
+	totalSize  uint64                  // Total size of managed space
+	pageSize   uint32                  // Size of each page
+	allocated  uint64                  // Total allocated space
+	dirty      []uint64                // Dirty level0 chunks since the last checkpoint
+	fullDirty  bool                    // Whether the next checkpoint must be a full image
+	generation uint64                  // Checkpoint generation the state is at or past
+	journal    atomic.Pointer[Journal] // Optional write-ahead journal of Allocate/Free
+	nextFit    bool                    // Whether Allocate resumes from cursor
+	cursor     uint64                  // Bit just past the most recent allocation
+	mu         sync.RWMutex
 }
 
 // NewBitmapAllocator creates a new bitmap allocator
@@ -49,69 +62,263 @@ func (b *BitmapAllocator) Init(size uint64, pageSize uint32) {
 	numWords := (numBits + 63) / 64
 	b.level0 = make([]uint64, numWords)
 
-	// Calculate number of bits needed for level 1
-	numLevel1Words := (numWords + bitsPerUnitSet - 1) / bitsPerUnitSet
-	b.level1 = make([]uint64, numLevel1Words)
-
-	// Initialize all bits to 0 (free)
+	// Initialize all bits to 0 (free) and derive the level 1 summaries
 	for i := range b.level0 {
 		b.level0[i] = allUnitClear
 	}
-	for i := range b.level1 {
-		b.level1[i] = allUnitClear
-	}
+	b.initLevel1()
 
 	b.allocated = 0
+	b.resetDirty(true)
+}
+
+// Allocate allocates space of the specified size. In next-fit mode the
+// search starts where the previous allocation ended.
+func (b *BitmapAllocator) Allocate(size uint64) (*Result, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var fromBit uint64
+	if b.nextFit {
+		fromBit = b.cursor
+	}
+	return b.allocate(size, b.firstFit(fromBit, 1), b.journal.Load())
+}
+
+// AllocateNear allocates space of the specified size at the free run whose
+// start is nearest to hint, searching outward from it in both directions
+// and preferring the later run on a tie. Passing the end of a previous
+// extent places the new one right behind it when possible.
+func (b *BitmapAllocator) AllocateNear(size, hint uint64) (*Result, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.allocate(size, b.nearest(hint/uint64(b.pageSize)), b.journal.Load())
+}
+
+// AllocateAligned allocates space of the specified size at an offset that is
+// a multiple of align. align must be a power of two and a multiple of the
+// page size.
+func (b *BitmapAllocator) AllocateAligned(size, align uint64) (*Result, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !isPowerOfTwo(align) || align%uint64(b.pageSize) != 0 {
+		return nil, fmt.Errorf("alignment %d is not a power-of-two multiple of the page size %d", align, b.pageSize)
+	}
+	return b.allocate(size, b.firstFit(0, align/uint64(b.pageSize)), b.journal.Load())
+}
+
+// AllocateAt claims the exact range starting at offset, rounded up to whole
+// pages. It fails with a *RangeAllocatedError if any page in the range is
+// already allocated, so that metadata replay and fsck rebuild the bitmap
+// deterministically.
+func (b *BitmapAllocator) AllocateAt(offset, size uint64) (*Result, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if size == 0 {
+		return nil, ErrZeroSize
+	}
+	if offset%uint64(b.pageSize) != 0 {
+		return nil, fmt.Errorf("%w: %d", ErrMisaligned, offset)
+	}
+	length := bitmapRoundup(size, uint64(b.pageSize))
+	if length < size {
+		return nil, fmt.Errorf("%w: %d bytes at %d", ErrOutOfRange, size, offset)
+	}
+	if offset > b.totalSize || length > b.totalSize-offset {
+		return nil, fmt.Errorf("%w: [%d, %d)", ErrOutOfRange, offset, offset+length)
+	}
+
+	startBit := offset / uint64(b.pageSize)
+	numPages := length / uint64(b.pageSize)
+	if bit, ok := b.firstAllocated(startBit, numPages); ok {
+		return nil, &RangeAllocatedError{
+			Offset:    offset,
+			Size:      length,
+			Allocated: bit * uint64(b.pageSize),
+		}
+	}
+
+	// Log the allocation before applying it
+	if journal := b.journal.Load(); journal != nil {
+		if _, err := journal.Append(JournalAlloc, offset, length); err != nil {
+			return nil, err
+		}
+	}
+
+	b.markAllocated(startBit, numPages)
+	b.allocated += length
+
+	return &Result{
+		Offset: offset,
+		Size:   length,
+	}, nil
+}
+
+// MarkUsed marks the range starting at offset as allocated, like AllocateAt
+func (b *BitmapAllocator) MarkUsed(offset, size uint64) error {
+	_, err := b.AllocateAt(offset, size)
+	return err
 }
 
-// Allocate allocates space of the specified size
-func (b *BitmapAllocator) Allocate(size uint32) *Result {
+// SetNextFit enables or disables next-fit mode, in which Allocate resumes
+// searching from the end of the previous allocation instead of the start
+func (b *BitmapAllocator) SetNextFit(enabled bool) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	b.nextFit = enabled
+}
+
+// allocate allocates space at the free run that find picks, and logs it to
+// journal unless that is nil; the caller must hold b.mu
+func (b *BitmapAllocator) allocate(size uint64, find searchFunc, journal *Journal) (*Result, error) {
 	if size == 0 {
-		return &Result{Success: false}
+		return nil, ErrZeroSize
+	}
+	length := bitmapRoundup(size, uint64(b.pageSize))
+	if length < size {
+		// Within a page of 2^64, size cannot even be rounded up
+		return nil, b.spaceError(size, b.largestFree())
 	}
-	length := bitmapRoundup(uint64(size), uint64(b.pageSize))
 	// Calculate number of pages needed
 	numPages := (length + uint64(b.pageSize) - 1) / uint64(b.pageSize)
 
 	// Check if we have enough total space
 	if numPages*uint64(b.pageSize) > b.totalSize-b.allocated {
-		return &Result{Success: false}
+		return nil, b.spaceError(length, b.largestFree())
 	}
 
-	startBit := b.findFreeSpace(numPages)
+	startBit, longest := find(numPages)
 	if startBit == ^uint64(0) {
-		return &Result{Success: false}
+		return nil, b.spaceError(length, longest)
 	}
 
 	// Verify the allocation is within bounds
 	if startBit*uint64(b.pageSize)+length > b.totalSize {
-		return &Result{Success: false}
+		return nil, b.spaceError(length, b.largestFree())
+	}
+
+	// Log the allocation before applying it
+	if journal != nil {
+		if _, err := journal.Append(JournalAlloc, startBit*uint64(b.pageSize), length); err != nil {
+			return nil, err
+		}
 	}
 
 	// Mark space as allocated in both levels
 	b.markAllocated(startBit, numPages)
 	b.allocated += length
+	b.cursor = startBit + numPages
 
 	return &Result{
-		Success: true,
-		Offset:  startBit * uint64(b.pageSize),
-		Size:    length,
+		Offset: startBit * uint64(b.pageSize),
+		Size:   length,
+	}, nil
+}
+
+// searchFunc finds a run of numPages free pages like findFreeSpace, for
+// allocate to use
+type searchFunc func(numPages uint64) (startBit, longest uint64)
+
+// firstFit searches for the first free run at or after fromBit that starts
+// at a multiple of alignPages, wrapping around to the start of the space
+func (b *BitmapAllocator) firstFit(fromBit, alignPages uint64) searchFunc {
+	return func(numPages uint64) (uint64, uint64) {
+		startBit, longest := b.findFreeSpace(numPages, fromBit, alignPages)
+		if startBit == ^uint64(0) && fromBit > 0 {
+			startBit, longest = b.findFreeSpace(numPages, 0, alignPages)
+		}
+		return startBit, longest
+	}
+}
+
+// nearest searches for the free run whose start is nearest to hintBit. The
+// search before hintBit only goes as far back as the run found after it.
+func (b *BitmapAllocator) nearest(hintBit uint64) searchFunc {
+	return func(numPages uint64) (uint64, uint64) {
+		after, longest := b.findFreeSpace(numPages, hintBit, 1)
+		if after == hintBit {
+			return after, 0
+		}
+		limit := uint64(0)
+		if after != ^uint64(0) {
+			limit = hintBit - min(hintBit, after-hintBit-1)
+		}
+		if before, ok := b.findFreeSpaceBefore(numPages, hintBit, limit); ok {
+			return before, 0
+		}
+		if after == ^uint64(0) && hintBit > 0 {
+			// Neither scan covered the whole space
+			longest = b.largestFree()
+		}
+		return after, longest
 	}
 }
 
-// Free releases allocated space
-func (b *BitmapAllocator) Free(offset, size uint32) {
+// spaceError describes why length bytes could not be allocated, given the
+// longest free run in pages; the caller must hold b.mu
+func (b *BitmapAllocator) spaceError(length, longest uint64) error {
+	return newSpaceError(length, b.totalSize-b.allocated, longest*uint64(b.pageSize))
+}
+
+// largestFree returns the number of pages in the longest free run, for
+// failures that did not search the bitmap; the caller must hold b.mu
+func (b *BitmapAllocator) largestFree() uint64 {
+	_, longest := b.findFreeSpace(uint64(len(b.level0))*bitsPerUnit+1, 0, 1)
+	return longest
+}
+
+// Free releases allocated space, rounded up to whole pages. Every page in
+// the range must currently be allocated.
+func (b *BitmapAllocator) Free(offset, size uint64) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	return b.free(offset, size, b.journal.Load())
+}
 
-	startBit := uint64(offset) / uint64(b.pageSize)
-	numPages := (uint64(size) + uint64(b.pageSize) - 1) / uint64(b.pageSize)
-	b.markFree(startBit, numPages)
-	if b.allocated >= uint64(size) {
-		b.allocated -= uint64(size)
+// free releases allocated space and logs it to journal unless that is nil;
+// the caller must hold b.mu
+func (b *BitmapAllocator) free(offset, size uint64, journal *Journal) error {
+	if size == 0 {
+		return nil
+	}
+	if offset%uint64(b.pageSize) != 0 {
+		return fmt.Errorf("%w: %d", ErrMisaligned, offset)
+	}
+	length := bitmapRoundup(size, uint64(b.pageSize))
+	if length < size {
+		return fmt.Errorf("%w: %d bytes at %d", ErrOutOfRange, size, offset)
+	}
+	if offset > b.totalSize || length > b.totalSize-offset {
+		return fmt.Errorf("%w: [%d, %d)", ErrOutOfRange, offset, offset+length)
+	}
+
+	startBit := offset / uint64(b.pageSize)
+	numPages := length / uint64(b.pageSize)
+	if b.countAllocated(startBit, numPages) != numPages {
+		return fmt.Errorf("%w: [%d, %d)", ErrDoubleFree, offset, offset+length)
 	}
+
+	// Log the free before applying it
+	if journal != nil {
+		if _, err := journal.Append(JournalFree, offset, length); err != nil {
+			return err
+		}
+	}
+
+	b.markFree(startBit, numPages)
+	b.allocated -= length
+	return nil
+}
+
+// SetJournal attaches a journal that records every Allocate and Free before
+// it is applied. Reserved space is only recorded once it is committed.
+// Passing nil detaches the current journal.
+func (b *BitmapAllocator) SetJournal(j *Journal) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.journal.Store(j)
 }
 
 // GetUtilization returns the current space utilization
@@ -136,114 +343,236 @@ func (b *BitmapAllocator) GetTotalAllocated() uint64 {
 func (b *BitmapAllocator) GetMemoryUsage() uint64 {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
-	return uint64(len(b.level0)*8 + len(b.level1)*8)
+	return uint64(len(b.level0)*8 + len(b.level1)*8 + len(b.level1Free)*8)
 }
 
-func (b *BitmapAllocator) getBitPos(val uint64, start uint32) uint32 {
-	var mask uint64 = 1 << start
-	for {
-		if (start < bitsPerUnit) && (val&mask) == 0 {
-			mask <<= 1
-			start++
-			continue
+// CheckConsistency verifies that both level1 summaries agree with level0
+func (b *BitmapAllocator) CheckConsistency() error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	numWords := uint64(len(b.level0))
+	numUnitSets := (numWords + unitsPerUnitSet - 1) / unitsPerUnitSet
+	for unitSet := uint64(0); unitSet < uint64(len(b.level1))*64; unitSet++ {
+		full, free := false, false
+		if unitSet < numUnitSets {
+			full, free = b.unitSetState(unitSet)
+		}
+		mask := uint64(1) << (unitSet % 64)
+		if got := b.level1[unitSet/64]&mask != 0; got != full {
+			return fmt.Errorf("level1 full bit of unit set %d is %v, level0 says %v", unitSet, got, full)
+		}
+		if got := b.level1Free[unitSet/64]&mask != 0; got != free {
+			return fmt.Errorf("level1 free bit of unit set %d is %v, level0 says %v", unitSet, got, free)
 		}
-		break
 	}
-	return start
+	return nil
 }
 
-// findFreeSpace finds a contiguous block of free space using two-level bitmap
-func (b *BitmapAllocator) findFreeSpace(numPages uint64) uint64 {
-	if len(b.level0) == 0 || len(b.level1) == 0 || numPages == 0 {
-		return ^uint64(0)
+// findFreeSpace finds the first run of numPages free pages starting at or
+// after fromBit at a multiple of alignPages. It walks level0 a word at a
+// time, skipping unit sets that level1 marks as fully allocated, taking fully
+// free ones whole and using bit tricks inside partially allocated words.
+// When there is no such run it returns ^uint64(0) and the number of pages in
+// the longest free run at or after fromBit, for the error to report.
+func (b *BitmapAllocator) findFreeSpace(numPages, fromBit, alignPages uint64) (uint64, uint64) {
+	if len(b.level0) == 0 || len(b.level1) == 0 || numPages == 0 || alignPages == 0 {
+		return ^uint64(0), 0
+	}
+	// A trailing partial page has a bit but cannot be allocated
+	totalBits := b.totalSize / uint64(b.pageSize)
+	numWords := uint64(len(b.level0))
+
+	// fits reports where the current run can hold numPages aligned pages
+	var run, runStart, longest uint64
+	fits := func() (uint64, bool) {
+		start := bitmapRoundup(runStart, alignPages)
+		if start+numPages > runStart+run {
+			return 0, false
+		}
+		return start, true
 	}
-	// Calculate total available bits
-	totalBits := uint64(len(b.level0)) * 64
-	if totalBits*uint64(b.pageSize) > b.totalSize {
-		totalBits = (b.totalSize + uint64(b.pageSize) - 1) / uint64(b.pageSize)
+	// endRun records the current run, clipped to totalBits, as it ends
+	endRun := func() {
+		if run > 0 && runStart < totalBits {
+			longest = max(longest, min(run, totalBits-runStart))
+		}
+		run = 0
 	}
 
-	var consecutive uint64
-	var foundStart uint64
-
-	// First, check level1 to find potential free regions
-	for unitSetIdx := uint64(0); unitSetIdx < uint64(len(b.level1)); unitSetIdx++ {
-		// Skip if this unit set is fully allocated
-		if b.level1[unitSetIdx] == allUnitSet {
-			continue
+	for wordIdx := fromBit / bitsPerUnit; wordIdx < numWords; {
+		// Skip full unit sets and take free ones whole, 64 unit sets at a
+		// time when a level1 word allows it
+		if wordIdx%unitsPerUnitSet == 0 && wordIdx*bitsPerUnit >= fromBit {
+			unitSet := wordIdx / unitsPerUnitSet
+			span, full, free := uint64(1), b.level1[unitSet/64], b.level1Free[unitSet/64]
+			if unitSet%64 == 0 && (full == allUnitSet || free == allUnitSet) {
+				span = 64
+			} else {
+				full &= uint64(1) << (unitSet % 64)
+				free &= uint64(1) << (unitSet % 64)
+			}
+			if full != 0 {
+				endRun()
+				wordIdx += span * unitsPerUnitSet
+				continue
+			}
+			if free != 0 {
+				if run == 0 {
+					runStart = wordIdx * bitsPerUnit
+				}
+				run += span * bitsPerUnitSet
+				wordIdx += span * unitsPerUnitSet
+				if start, ok := fits(); ok {
+					if start+numPages > totalBits {
+						endRun()
+						return ^uint64(0), longest
+					}
+					return start, 0
+				}
+				continue
+			}
 		}
 
-		// Check each bit in the unit set
-		for bitIdx := uint64(0); bitIdx < 64; bitIdx++ {
-			if b.level1[unitSetIdx]&(uint64(1)<<bitIdx) == 0 {
-				// Found a potentially free unit set
-				// Calculate the starting bit position in level0
-				startBit := (unitSetIdx*64 + bitIdx) * bitsPerUnitSet
-				endBit := startBit + bitsPerUnitSet
-				if endBit > totalBits {
-					endBit = totalBits
+		word := b.level0[wordIdx]
+		if wordIdx == fromBit/bitsPerUnit {
+			// Pages before fromBit are not candidates
+			word |= (uint64(1) << (fromBit % bitsPerUnit)) - 1
+		}
+		switch word {
+		case allUnitClear:
+			if run == 0 {
+				runStart = wordIdx * bitsPerUnit
+			}
+			run += bitsPerUnit
+		case allUnitSet:
+			endRun()
+		default:
+			for bitPos := uint64(0); bitPos < bitsPerUnit; {
+				rest := word >> bitPos
+				free := bitsPerUnit - bitPos
+				if rest != 0 {
+					free = uint64(bits.TrailingZeros64(rest))
 				}
-
-				// Check level0 for consecutive free pages
-				for bit := startBit; bit < endBit; bit++ {
-					wordIdx := bit / 64
-					bitPos := bit % 64
-					if wordIdx >= uint64(len(b.level0)) {
+				if free > 0 {
+					if run == 0 {
+						runStart = wordIdx*bitsPerUnit + bitPos
+					}
+					run += free
+					if _, ok := fits(); ok {
 						break
 					}
-
-					if b.level0[wordIdx]&(uint64(1)<<bitPos) == 0 {
-						if consecutive == 0 {
-							foundStart = bit
-						}
-						consecutive++
-						if consecutive >= numPages {
-							return foundStart
-						}
-					} else {
-						consecutive = 0
-						foundStart = 0
+					bitPos += free
+					if bitPos >= bitsPerUnit {
+						break
 					}
 				}
+				endRun()
+				bitPos += uint64(bits.TrailingZeros64(^(word >> bitPos)))
+			}
+		}
 
-				// If we found some free pages but not enough, continue searching
-				// in the next unit set
-				if consecutive > 0 {
-					// Check if we can find more free pages in the next unit set
-					nextUnitSet := unitSetIdx + 1
-					if nextUnitSet < uint64(len(b.level1)) && b.level1[nextUnitSet]&(uint64(1)<<0) == 0 {
-						nextStartBit := nextUnitSet * 64 * bitsPerUnitSet
-						nextEndBit := nextStartBit + bitsPerUnitSet
-						if nextEndBit > totalBits {
-							nextEndBit = totalBits
-						}
-
-						for bit := nextStartBit; bit < nextEndBit; bit++ {
-							wordIdx := bit / 64
-							bitPos := bit % 64
-							if wordIdx >= uint64(len(b.level0)) {
-								break
-							}
-
-							if b.level0[wordIdx]&(uint64(1)<<bitPos) == 0 {
-								consecutive++
-								if consecutive >= numPages {
-									return foundStart
-								}
-							} else {
-								break
-							}
-						}
-					}
-				}
-			} else {
-				consecutive = 0
-				foundStart = 0
+		if start, ok := fits(); ok {
+			if start+numPages > totalBits {
+				endRun()
+				return ^uint64(0), longest
 			}
+			return start, 0
 		}
+		wordIdx++
 	}
+	endRun()
+	return ^uint64(0), longest
+}
 
-	return ^uint64(0)
+// findFreeSpaceBefore finds the last start in [minBit, beforeBit) of a run
+// of numPages free pages. It walks level0 backwards a word at a time from
+// the last page such a run could take, skipping or taking whole unit sets
+// that level1 marks as fully allocated or free.
+func (b *BitmapAllocator) findFreeSpaceBefore(numPages, beforeBit, minBit uint64) (uint64, bool) {
+	if len(b.level0) == 0 || len(b.level1) == 0 || numPages == 0 || beforeBit <= minBit {
+		return 0, false
+	}
+	// Pages at or past top cannot be part of a run starting before beforeBit
+	top := min(beforeBit-1+numPages, b.totalSize/uint64(b.pageSize))
+	if top < numPages {
+		return 0, false
+	}
+
+	// A run is counted downwards from runEnd; the first one to reach
+	// numPages pages holds the last start
+	var run, runEnd uint64
+	grow := func(end, free uint64) bool {
+		if run == 0 {
+			runEnd = end
+		}
+		run += free
+		return run >= numPages
+	}
+	found := func() (uint64, bool) {
+		if start := runEnd - numPages; start >= minBit {
+			return start, true
+		}
+		return 0, false
+	}
+
+	for wordIdx := (top - 1) / bitsPerUnit; ; wordIdx-- {
+		if wordIdx*bitsPerUnit+bitsPerUnit <= minBit {
+			return 0, false
+		}
+		// Skip full unit sets and take free ones whole when entering them
+		// from the top
+		if wordIdx%unitsPerUnitSet == unitsPerUnitSet-1 && (wordIdx+1)*bitsPerUnit <= top {
+			unitSet := wordIdx / unitsPerUnitSet
+			bit := uint64(1) << (unitSet % 64)
+			if b.level1[unitSet/64]&bit != 0 {
+				run = 0
+				if wordIdx < unitsPerUnitSet {
+					return 0, false
+				}
+				wordIdx -= unitsPerUnitSet - 1
+				continue
+			}
+			if b.level1Free[unitSet/64]&bit != 0 {
+				if grow((wordIdx+1)*bitsPerUnit, bitsPerUnitSet) {
+					return found()
+				}
+				if wordIdx < unitsPerUnitSet {
+					return 0, false
+				}
+				wordIdx -= unitsPerUnitSet - 1
+				continue
+			}
+		}
+
+		word := b.level0[wordIdx]
+		if end := (wordIdx + 1) * bitsPerUnit; end > top {
+			// Pages at or past top are not candidates
+			word |= ^uint64(0) << (top % bitsPerUnit)
+		}
+		for bitPos := uint64(bitsPerUnit); bitPos > 0; {
+			// Free pages directly below bitPos, then the allocated ones
+			below := word << (bitsPerUnit - bitPos)
+			free := bitPos
+			if below != 0 {
+				free = uint64(bits.LeadingZeros64(below))
+			}
+			if free > 0 {
+				if grow(wordIdx*bitsPerUnit+bitPos, free) {
+					return found()
+				}
+				bitPos -= free
+				if bitPos == 0 {
+					break
+				}
+			}
+			run = 0
+			bitPos -= uint64(bits.LeadingZeros64(^(word << (bitsPerUnit - bitPos))))
+		}
+		if wordIdx == 0 {
+			return 0, false
+		}
+	}
 }
 
 // bitmapAlign aligns x to the nearest lower multiple of align
@@ -258,100 +587,133 @@ func bitmapRoundup(x uint64, align uint64) uint64 {
 
 // markAllocated marks a range of bits as allocated in both levels
 func (b *BitmapAllocator) markAllocated(startBit, numPages uint64) {
-	// Mark bits in level0
-	endBit := startBit + numPages
-	for bit := startBit; bit < endBit; bit++ {
-		wordIdx := bit / 64
-		bitPos := bit % 64
-		if wordIdx >= uint64(len(b.level0)) {
-			break
-		}
-		b.level0[wordIdx] |= uint64(1) << bitPos
+	b.forEachWordMask(startBit, numPages, func(wordIdx, mask uint64) {
+		b.level0[wordIdx] |= mask
+	})
+	b.updateRange(startBit, numPages)
+}
+
+// markFree marks a range of bits as free in both levels
+func (b *BitmapAllocator) markFree(startBit, numPages uint64) {
+	b.forEachWordMask(startBit, numPages, func(wordIdx, mask uint64) {
+		b.level0[wordIdx] &^= mask
+	})
+	b.updateRange(startBit, numPages)
+}
+
+// initLevel1 allocates both level1 summaries and derives them from level0
+func (b *BitmapAllocator) initLevel1() {
+	numWords := uint64(len(b.level0))
+	numLevel1Words := (numWords + bitsPerUnitSet - 1) / bitsPerUnitSet
+	b.level1 = make([]uint64, numLevel1Words)
+	b.level1Free = make([]uint64, numLevel1Words)
+	b.updateLevel1(0, numWords)
+}
+
+// updateLevel1 recomputes the level1 bits covering level0 words [startWord, endWord)
+func (b *BitmapAllocator) updateLevel1(startWord, endWord uint64) {
+	numWords := uint64(len(b.level0))
+	if endWord > numWords {
+		endWord = numWords
 	}
-	startBit = p2align(startBit, bitsPerUnitSet)
-	endBit = p2roundup(endBit, bitsPerUnitSet)
-	// Update level1 bitmap
-	startUnitSet := startBit / bitsPerUnitSet
-	endUnitSet := (endBit + bitsPerUnitSet - 1) / bitsPerUnitSet
+	startUnitSet := startWord / unitsPerUnitSet
+	endUnitSet := (endWord + unitsPerUnitSet - 1) / unitsPerUnitSet
 	for unitSet := startUnitSet; unitSet < endUnitSet; unitSet++ {
-		if unitSet >= uint64(len(b.level1))*64 {
-			break
+		full, free := b.unitSetState(unitSet)
+		mask := uint64(1) << (unitSet % 64)
+		if full {
+			b.level1[unitSet/64] |= mask
+		} else {
+			b.level1[unitSet/64] &^= mask
 		}
-		// Check if any bits in the unit set are allocated
-		startWord := unitSet * bitsPerUnitSet / 64
-		endWord := (unitSet + 1) * bitsPerUnitSet / 64
-		if endWord > uint64(len(b.level0)) {
-			endWord = uint64(len(b.level0))
+		if free {
+			b.level1Free[unitSet/64] |= mask
+		} else {
+			b.level1Free[unitSet/64] &^= mask
 		}
+	}
+}
 
-		// Check if all bits in the unit set are allocated
-		allAllocated := true
-		for wordIdx := startWord; wordIdx < endWord; wordIdx++ {
-			if b.level0[wordIdx] != allUnitSet {
-				allAllocated = false
-				break
-			}
-		}
-		// Update level1 bitmap
-		level1Idx := unitSet / 64
-		level1Bit := unitSet % 64
-		if level1Idx < uint64(len(b.level1)) {
-			if allAllocated {
-				b.level1[level1Idx] |= uint64(1) << level1Bit
-			}
-		}
+// unitSetState reports whether a unit set is fully allocated and whether it
+// is fully free according to level0
+func (b *BitmapAllocator) unitSetState(unitSet uint64) (full, free bool) {
+	first := unitSet * unitsPerUnitSet
+	last := first + unitsPerUnitSet
+	if last > uint64(len(b.level0)) {
+		last = uint64(len(b.level0))
+	}
+	full, free = true, true
+	for wordIdx := first; wordIdx < last; wordIdx++ {
+		word := b.level0[wordIdx]
+		full = full && word == allUnitSet
+		free = free && word == allUnitClear
 	}
+	return full, free
 }
 
-// markFree marks a range of bits as free in both levels
-func (b *BitmapAllocator) markFree(startBit, numPages uint64) {
-	// Mark bits in level0
+// updateRange refreshes level1 and the dirty state after level0 bits in a
+// range were modified
+func (b *BitmapAllocator) updateRange(startBit, numPages uint64) {
+	startWord := startBit / bitsPerUnit
+	endWord := (startBit + numPages + bitsPerUnit - 1) / bitsPerUnit
+	b.updateLevel1(startWord, endWord)
+	b.markDirty(startWord, endWord)
+}
+
+// forEachWordMask calls fn with the level0 word index and bit mask of each
+// word overlapping a range of bits, clipped to level0
+func (b *BitmapAllocator) forEachWordMask(startBit, numPages uint64, fn func(wordIdx, mask uint64)) {
 	endBit := startBit + numPages
-	for bit := startBit; bit < endBit; bit++ {
-		wordIdx := bit / 64
-		bitPos := bit % 64
-		if wordIdx >= uint64(len(b.level0)) {
-			break
-		}
-		b.level0[wordIdx] &= ^(uint64(1) << bitPos)
+	if maxBit := uint64(len(b.level0)) * bitsPerUnit; endBit > maxBit {
+		endBit = maxBit
 	}
-
-	// Update level1 bitmap
-	startUnitSet := startBit / bitsPerUnitSet
-	endUnitSet := (endBit + bitsPerUnitSet - 1) / bitsPerUnitSet
-	for unitSet := startUnitSet; unitSet < endUnitSet; unitSet++ {
-		if unitSet >= uint64(len(b.level0))*64/bitsPerUnitSet {
-			break
+	for bit := startBit; bit < endBit; {
+		wordIdx := bit / bitsPerUnit
+		bitPos := bit % bitsPerUnit
+		n := bitsPerUnit - bitPos
+		if n > endBit-bit {
+			n = endBit - bit
 		}
-		// Check if any bits in the unit set are allocated
-		startWord := unitSet * bitsPerUnitSet / 64
-		endWord := (unitSet + 1) * bitsPerUnitSet / 64
-		if endWord > uint64(len(b.level0)) {
-			endWord = uint64(len(b.level0))
+		mask := uint64(allUnitSet)
+		if n < bitsPerUnit {
+			mask = ((uint64(1) << n) - 1) << bitPos
 		}
+		fn(wordIdx, mask)
+		bit += n
+	}
+}
 
-		hasAllocated := false
-		for wordIdx := startWord; wordIdx < endWord; wordIdx++ {
-			if b.level0[wordIdx] != allUnitClear {
-				hasAllocated = true
-				break
-			}
-		}
+// fillAllocated marks the whole space as allocated
+func (b *BitmapAllocator) fillAllocated() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-		level1Idx := unitSet / 64
-		level1Bit := unitSet % 64
-		if hasAllocated {
-			b.level1[level1Idx] |= uint64(1) << level1Bit
-		} else {
-			b.level1[level1Idx] &= ^(uint64(1) << level1Bit)
-		}
+	for i := range b.level0 {
+		b.level0[i] = allUnitSet
 	}
+	b.updateLevel1(0, uint64(len(b.level0)))
+	b.allocated = b.totalSize
+	b.resetDirty(true)
 }
 
-func p2align(x uint64, align uint64) uint64 {
-	return x & -align
+// firstAllocated returns the first allocated page in a range of pages
+func (b *BitmapAllocator) firstAllocated(startBit, numPages uint64) (uint64, bool) {
+	found := false
+	var first uint64
+	b.forEachWordMask(startBit, numPages, func(wordIdx, mask uint64) {
+		if used := b.level0[wordIdx] & mask; used != 0 && !found {
+			found = true
+			first = wordIdx*bitsPerUnit + uint64(bits.TrailingZeros64(used))
+		}
+	})
+	return first, found
 }
 
-func p2roundup(x uint64, align uint64) uint64 {
-	return -(-x & -align)
+// countAllocated returns the number of allocated pages in a range of bits
+func (b *BitmapAllocator) countAllocated(startBit, numPages uint64) uint64 {
+	var count uint64
+	b.forEachWordMask(startBit, numPages, func(wordIdx, mask uint64) {
+		count += uint64(bits.OnesCount64(b.level0[wordIdx] & mask))
+	})
+	return count
 }
@@ -0,0 +1,424 @@
+package segment
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// TestBitmapAllocatorBeyond4GiB allocates, claims and frees ranges past
+// 4 GiB and up to the end of a maxDiskSize space. A range whose offset or
+// size were truncated to 32 bits would land on, or free, the range at its
+// offset modulo 4 GiB instead.
+func TestBitmapAllocatorBeyond4GiB(t *testing.T) {
+	const gib = 1 << 30
+	b := NewBitmapAllocator()
+	b.Init(maxDiskSize, blockSize)
+
+	// Each range has a twin at its offset modulo 4 GiB
+	ranges := []Extent{
+		{Offset: 4 * gib, Size: 1 << 20},
+		{Offset: 12*gib - blockSize, Size: 2 * blockSize}, // Straddles 12 GiB
+		{Offset: 5*gib + 12*blockSize, Size: 6 * gib},     // Larger than 4 GiB
+		{Offset: maxDiskSize - 1<<20, Size: 1 << 20},
+	}
+	var total uint64
+	for _, r := range ranges {
+		res, err := b.AllocateAt(r.Offset, r.Size)
+		if err != nil {
+			t.Fatalf("failed to claim [%d, %d): %v", r.Offset, r.Offset+r.Size, err)
+		}
+		if res.Offset != r.Offset || res.Size != r.Size {
+			t.Fatalf("claim of [%d, %d) returned [%d, %d)", r.Offset, r.Offset+r.Size, res.Offset, res.Offset+res.Size)
+		}
+		total += r.Size
+	}
+	if got := b.GetTotalAllocated(); got != total {
+		t.Fatalf("%d bytes are allocated, want %d", got, total)
+	}
+
+	// The claimed ranges are taken, their twins below 4 GiB are not
+	for _, r := range ranges {
+		var rangeErr *RangeAllocatedError
+		if _, err := b.AllocateAt(r.Offset, blockSize); !errors.As(err, &rangeErr) || rangeErr.Allocated != r.Offset {
+			t.Fatalf("claiming %d again: got %v, want a *RangeAllocatedError at %d", r.Offset, err, r.Offset)
+		}
+		twin := r.Offset % (4 * gib)
+		if _, err := b.AllocateAt(twin, blockSize); err != nil {
+			t.Fatalf("failed to claim %d, the twin of %d: %v", twin, r.Offset, err)
+		}
+		if err := b.Free(twin, blockSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Allocations are placed past 4 GiB and may be larger than 4 GiB
+	for _, want := range []Extent{
+		{Offset: 64 * gib, Size: 5 * gib},
+		{Offset: maxDiskSize - 2<<20, Size: blockSize},
+	} {
+		res, err := b.AllocateNear(want.Size, want.Offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Offset != want.Offset || res.Size != want.Size {
+			t.Fatalf("allocation of %d bytes near %d returned [%d, %d)",
+				want.Size, want.Offset, res.Offset, res.Offset+res.Size)
+		}
+		if err := b.Free(res.Offset, res.Size); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, r := range ranges {
+		if err := b.Free(r.Offset, r.Size); err != nil {
+			t.Fatalf("failed to free [%d, %d): %v", r.Offset, r.Offset+r.Size, err)
+		}
+		if err := b.Free(r.Offset, r.Size); !errors.Is(err, ErrDoubleFree) {
+			t.Fatalf("freeing [%d, %d) again: got %v, want ErrDoubleFree", r.Offset, r.Offset+r.Size, err)
+		}
+	}
+	if got := b.GetTotalAllocated(); got != 0 {
+		t.Fatalf("%d bytes are still allocated after freeing everything", got)
+	}
+	if err := b.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllocateNear(t *testing.T) {
+	tests := []struct {
+		name      string
+		allocated []uint64 // Pages allocated beforehand in a 16-page space
+		hint      uint64   // Hint page
+		pages     uint64
+		want      uint64 // Start page, ^uint64(0) if the request must fail
+	}{
+		{"at hint", nil, 5, 2, 5},
+		{"after hint", []uint64{2, 3, 4, 5, 6}, 5, 2, 7},
+		{"before hint", []uint64{5, 6, 7, 8, 9, 10, 11}, 6, 2, 3},
+		{"tie prefers after", []uint64{4, 5, 6, 7}, 5, 2, 8},
+		{"nothing after", []uint64{12, 13, 14, 15}, 13, 2, 10},
+		{"hint past the end", nil, 40, 3, 13},
+		{"no run large enough", []uint64{3, 7, 11, 15}, 8, 4, ^uint64(0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newPagesBitmap(t, 16*blockSize, tt.allocated...)
+			res, err := b.AllocateNear(tt.pages*blockSize, tt.hint*blockSize)
+			if tt.want == ^uint64(0) {
+				var spaceErr *SpaceError
+				if !errors.As(err, &spaceErr) || spaceErr.LargestFree != 3*blockSize {
+					t.Fatalf("got %v, %v, want a *SpaceError with 3 pages as the largest free extent", res, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Offset != tt.want*blockSize {
+				t.Fatalf("allocation near page %d landed at page %d, want %d", tt.hint, res.Offset/blockSize, tt.want)
+			}
+		})
+	}
+}
+
+// TestNextFit checks that next-fit allocations resume after the previous
+// one, skipping space freed behind it, and wrap around at the end
+func TestNextFit(t *testing.T) {
+	b := newPagesBitmap(t, 16*blockSize)
+	b.SetNextFit(true)
+	allocate := func(pages, want uint64) {
+		t.Helper()
+		res, err := b.Allocate(pages * blockSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Offset != want*blockSize {
+			t.Fatalf("allocation of %d pages landed at page %d, want %d", pages, res.Offset/blockSize, want)
+		}
+	}
+
+	allocate(4, 0)
+	allocate(4, 4)
+	if err := b.Free(0, 4*blockSize); err != nil {
+		t.Fatal(err)
+	}
+	allocate(4, 8)
+	allocate(2, 12)
+	allocate(4, 0) // Only 2 pages are left after the cursor
+	allocate(2, 14)
+
+	b.SetNextFit(false)
+	if err := b.Free(4*blockSize, 4*blockSize); err != nil {
+		t.Fatal(err)
+	}
+	allocate(1, 4)
+}
+
+// TestBitmapAllocatorConsistency runs random Allocate, AllocateAligned,
+// AllocateAt and Free sequences, including frees of part of an allocation,
+// and checks after every step that both level1 summaries agree with level0
+// and that the allocated byte count matches the live allocations
+func TestBitmapAllocatorConsistency(t *testing.T) {
+	const operations = 3000
+	for seed := int64(1); seed <= 3; seed++ {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(seed))
+			size := 32<<20 + uint64(rng.Int63n(1<<20)) // Ends in a partial unit set and page
+			b := NewBitmapAllocator()
+			b.Init(size, blockSize)
+
+			var live []Extent
+			var liveBytes uint64
+			for i := 0; i < operations; i++ {
+				var res *Result
+				var err error
+				switch op := rng.Intn(8); {
+				case op < 3 && len(live) > 0:
+					idx := rng.Intn(len(live))
+					ext := live[idx]
+					// Free either all of it or its front part
+					freed := ext.Size
+					if rng.Intn(2) == 0 {
+						freed = bitmapRoundup(uint64(rng.Int63n(int64(ext.Size)))+1, blockSize)
+					}
+					if err := b.Free(ext.Offset, freed); err != nil {
+						t.Fatalf("operation %d: failed to free [%d, %d): %v", i, ext.Offset, ext.Offset+freed, err)
+					}
+					liveBytes -= freed
+					if freed < ext.Size {
+						live[idx] = Extent{Offset: ext.Offset + freed, Size: ext.Size - freed}
+					} else {
+						live[idx] = live[len(live)-1]
+						live = live[:len(live)-1]
+					}
+				case op < 5:
+					// Up to a few unit sets, so that whole ones fill and empty
+					res, err = b.Allocate(uint64(rng.Int63n(3*bitsPerUnitSet*blockSize)) + 1)
+				case op < 6:
+					res, err = b.AllocateAligned(uint64(rng.Int63n(1<<20))+1, bitsPerUnitSet*blockSize)
+				default:
+					offset := uint64(rng.Int63n(int64(size))) &^ (blockSize - 1)
+					res, err = b.AllocateAt(offset, uint64(rng.Int63n(1<<20))+1)
+				}
+				var spaceErr *SpaceError
+				var rangeErr *RangeAllocatedError
+				switch {
+				case errors.As(err, &spaceErr), errors.As(err, &rangeErr), errors.Is(err, ErrOutOfRange):
+				case err != nil:
+					t.Fatalf("operation %d: %v", i, err)
+				case res != nil:
+					live = append(live, Extent{Offset: res.Offset, Size: res.Size})
+					liveBytes += res.Size
+				}
+
+				if err := b.CheckConsistency(); err != nil {
+					t.Fatalf("operation %d: %v", i, err)
+				}
+				if got := b.GetTotalAllocated(); got != liveBytes {
+					t.Fatalf("operation %d: %d bytes are allocated, want %d", i, got, liveBytes)
+				}
+			}
+
+			for _, ext := range live {
+				if err := b.Free(ext.Offset, ext.Size); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := b.CheckConsistency(); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.countAllocated(0, uint64(len(b.level0))*bitsPerUnit); got != 0 {
+				t.Fatalf("%d pages are still allocated after freeing everything", got)
+			}
+		})
+	}
+}
+
+// findFreeSpacePerBit is the bit-at-a-time search that findFreeSpace
+// replaced, kept as a reference for its results and speed
+func findFreeSpacePerBit(b *BitmapAllocator, numPages, fromBit, alignPages uint64) uint64 {
+	var run, runStart uint64
+	for bit := fromBit; bit < b.totalSize/uint64(b.pageSize); bit++ {
+		if b.level0[bit/bitsPerUnit]&(uint64(1)<<(bit%bitsPerUnit)) != 0 {
+			run = 0
+			continue
+		}
+		if run == 0 {
+			runStart = bit
+		}
+		run++
+		if start := bitmapRoundup(runStart, alignPages); start+numPages <= runStart+run {
+			return start
+		}
+	}
+	return ^uint64(0)
+}
+
+// findFreeSpaceBeforePerBit is the bit-at-a-time version of
+// findFreeSpaceBefore, kept as a reference for its correctness
+func findFreeSpaceBeforePerBit(b *BitmapAllocator, numPages, beforeBit, minBit uint64) (uint64, bool) {
+	var run uint64
+	for bit := min(beforeBit-1+numPages, b.totalSize/uint64(b.pageSize)); bit > minBit; {
+		bit--
+		if b.level0[bit/bitsPerUnit]&(uint64(1)<<(bit%bitsPerUnit)) != 0 {
+			run = 0
+			continue
+		}
+		run++
+		if run == numPages {
+			return bit, bit < beforeBit
+		}
+	}
+	return 0, false
+}
+
+// markAllocatedPerBit is the bit-at-a-time marking that markAllocated
+// replaced, kept as a reference for its speed
+func markAllocatedPerBit(b *BitmapAllocator, startBit, numPages uint64) {
+	for bit := startBit; bit < startBit+numPages; bit++ {
+		b.level0[bit/bitsPerUnit] |= uint64(1) << (bit % bitsPerUnit)
+	}
+	b.updateRange(startBit, numPages)
+}
+
+// fragmentedBitmap returns a bitmap allocator over size bytes after a fixed
+// random sequence of operations: allocations between 512 bytes and 4 MiB,
+// three in ten of them freed again
+func fragmentedBitmap(tb testing.TB, size uint64, operations int) *BitmapAllocator {
+	rng := rand.New(rand.NewSource(1))
+	b := NewBitmapAllocator()
+	b.Init(size, blockSize)
+	var live []Extent
+	for i := 0; i < operations; i++ {
+		if len(live) > 0 && rng.Float64() < 0.3 {
+			idx := rng.Intn(len(live))
+			if err := b.Free(live[idx].Offset, live[idx].Size); err != nil {
+				tb.Fatal(err)
+			}
+			live[idx] = live[len(live)-1]
+			live = live[:len(live)-1]
+			continue
+		}
+		res, err := b.Allocate(uint64(rng.Int63n(4<<20-512) + 512))
+		if err == nil {
+			live = append(live, Extent{Offset: res.Offset, Size: res.Size})
+		}
+	}
+	return b
+}
+
+// TestFindFreeSpaceMatchesPerBit checks the word-level searches, forwards
+// and backwards, against bit-at-a-time ones on fragmented spaces that end in
+// partial words, unit sets and pages
+func TestFindFreeSpaceMatchesPerBit(t *testing.T) {
+	for seed := int64(1); seed <= 3; seed++ {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(seed))
+			size := uint64(rng.Int63n(64<<20)) + 1<<20
+			b := NewBitmapAllocator()
+			b.Init(size, blockSize)
+			totalBits := size / blockSize
+			for i := 0; i < 200; i++ {
+				start := uint64(rng.Int63n(int64(totalBits)))
+				numPages := min(uint64(rng.Int63n(2*bitsPerUnitSet))+1, totalBits-start)
+				if rng.Intn(2) == 0 {
+					b.markAllocated(start, numPages)
+				} else {
+					b.markFree(start, numPages)
+				}
+			}
+
+			// Leave the tail free so that runs reach the partial page
+			b.markFree(totalBits-bitsPerUnitSet, bitsPerUnitSet)
+
+			for i := 0; i < 2000; i++ {
+				numPages := uint64(rng.Int63n(4*bitsPerUnitSet)) + 1
+				fromBit := uint64(rng.Int63n(int64(totalBits)))
+				if rng.Intn(4) == 0 {
+					// Ask for a run that ends at or just past the last page
+					fromBit = totalBits - min(numPages, totalBits) + uint64(rng.Intn(2))
+				}
+				alignPages := uint64(1) << rng.Intn(10)
+				got, _ := b.findFreeSpace(numPages, fromBit, alignPages)
+				want := findFreeSpacePerBit(b, numPages, fromBit, alignPages)
+				if got != want {
+					t.Fatalf("findFreeSpace(%d, %d, %d) = %d, want %d", numPages, fromBit, alignPages, got, want)
+				}
+
+				beforeBit := fromBit + uint64(rng.Intn(2*bitsPerUnitSet))
+				minBit := uint64(rng.Int63n(int64(beforeBit) + 1))
+				if rng.Intn(2) == 0 {
+					minBit = 0
+				}
+				gotBefore, gotOK := b.findFreeSpaceBefore(numPages, beforeBit, minBit)
+				wantBefore, wantOK := findFreeSpaceBeforePerBit(b, numPages, beforeBit, minBit)
+				if gotBefore != wantBefore || gotOK != wantOK {
+					t.Fatalf("findFreeSpaceBefore(%d, %d, %d) = %d, %t, want %d, %t",
+						numPages, beforeBit, minBit, gotBefore, gotOK, wantBefore, wantOK)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkBitmapAllocateFree measures an Allocate+Free pair on a
+// fragmented 1 TiB space
+func BenchmarkBitmapAllocateFree(b *testing.B) {
+	a := fragmentedBitmap(b, maxDiskSize, 20000)
+	for _, size := range []uint64{4 << 10, 64 << 10, 1 << 20, 4 << 20} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				res, err := a.Allocate(size)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := a.Free(res.Offset, res.Size); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkFindFreeSpace compares the word-level search with the
+// bit-at-a-time one on a fragmented 1 TiB space
+func BenchmarkFindFreeSpace(b *testing.B) {
+	a := fragmentedBitmap(b, maxDiskSize, 20000)
+	for _, size := range []uint64{64 << 10, 4 << 20} {
+		numPages := size / blockSize
+		b.Run(fmt.Sprintf("word/size=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				a.findFreeSpace(numPages, 0, 1)
+			}
+		})
+		b.Run(fmt.Sprintf("per-bit/size=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				findFreeSpacePerBit(a, numPages, 0, 1)
+			}
+		})
+	}
+}
+
+// BenchmarkMarkAllocated compares word-level marking of a 4 MiB extent with
+// bit-at-a-time marking
+func BenchmarkMarkAllocated(b *testing.B) {
+	a := NewBitmapAllocator()
+	a.Init(maxDiskSize, blockSize)
+	const numPages = 4 << 20 / blockSize
+	startBit := uint64(3) // Not word aligned
+	b.Run("word", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			a.markAllocated(startBit, numPages)
+			a.markFree(startBit, numPages)
+		}
+	})
+	b.Run("per-bit", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			markAllocatedPerBit(a, startBit, numPages)
+			a.markFree(startBit, numPages)
+		}
+	})
+}
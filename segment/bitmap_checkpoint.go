@@ -0,0 +1,259 @@
+package segment
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	// Checkpoint constants
+	bitmapDeltaMagic   = 0x444d4253 // "SBMD" in little-endian
+	dirtyChunkWords    = 512        // level0 words per dirty chunk (4 KiB of bitmap)
+	fullImageThreshold = 0.5        // Dirty fraction above which a full image is written
+)
+
+// deltaHeader is the fixed-size header of an incremental checkpoint record.
+// It is followed by numChunks entries of a uint64 chunk index and the chunk's
+// level0 words; the last chunk of the bitmap may be shorter than dirtyChunkWords.
+// The record only applies to a state at generation base and moves it to
+// base+1.
+//
+// Layout (little-endian):
+//
+//	0  magic      uint32
+//	4  version    uint32
+//	8  totalSize  uint64
+//	16 allocated  uint64
+//	24 numChunks  uint64
+//	32 base       uint64
+//	40 chunkWords uint32
+//	44 checksum   uint32 (CRC32-C of bytes 0..43 followed by the chunk entries)
+type deltaHeader struct {
+	magic      uint32
+	version    uint32
+	totalSize  uint64
+	allocated  uint64
+	numChunks  uint64
+	base       uint64
+	chunkWords uint32
+	checksum   uint32
+}
+
+func (h *deltaHeader) encode(buf []byte) {
+	binary.LittleEndian.PutUint32(buf[0:], h.magic)
+	binary.LittleEndian.PutUint32(buf[4:], h.version)
+	binary.LittleEndian.PutUint64(buf[8:], h.totalSize)
+	binary.LittleEndian.PutUint64(buf[16:], h.allocated)
+	binary.LittleEndian.PutUint64(buf[24:], h.numChunks)
+	binary.LittleEndian.PutUint64(buf[32:], h.base)
+	binary.LittleEndian.PutUint32(buf[40:], h.chunkWords)
+	binary.LittleEndian.PutUint32(buf[44:], h.checksum)
+}
+
+func (h *deltaHeader) decode(buf []byte) {
+	h.magic = binary.LittleEndian.Uint32(buf[0:])
+	h.version = binary.LittleEndian.Uint32(buf[4:])
+	h.totalSize = binary.LittleEndian.Uint64(buf[8:])
+	h.allocated = binary.LittleEndian.Uint64(buf[16:])
+	h.numChunks = binary.LittleEndian.Uint64(buf[24:])
+	h.base = binary.LittleEndian.Uint64(buf[32:])
+	h.chunkWords = binary.LittleEndian.Uint32(buf[40:])
+	h.checksum = binary.LittleEndian.Uint32(buf[44:])
+}
+
+// Checkpoint writes the level0 chunks modified since the previous checkpoint
+// to w and clears the dirty state. A full image is written instead when the
+// allocator was re-initialized or when most chunks are dirty. Either way the
+// record starts a new generation, which the next incremental record builds
+// on.
+func (b *BitmapAllocator) Checkpoint(w io.Writer) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	numChunks := b.numChunks()
+	var dirtyChunks []uint64
+	for chunk := uint64(0); chunk < numChunks; chunk++ {
+		if b.dirty[chunk/64]&(uint64(1)<<(chunk%64)) != 0 {
+			dirtyChunks = append(dirtyChunks, chunk)
+		}
+	}
+
+	if b.fullDirty || float64(len(dirtyChunks)) > float64(numChunks)*fullImageThreshold {
+		b.generation++
+		if err := b.save(w); err != nil {
+			b.generation--
+			return err
+		}
+		b.resetDirty(false)
+		return nil
+	}
+
+	hdr := deltaHeader{
+		magic:      bitmapDeltaMagic,
+		version:    bitmapFormatVersion,
+		totalSize:  b.totalSize,
+		allocated:  b.allocated,
+		numChunks:  uint64(len(dirtyChunks)),
+		base:       b.generation,
+		chunkWords: dirtyChunkWords,
+	}
+	var hbuf [bitmapHeaderSize]byte
+	hdr.encode(hbuf[:])
+	crc := crc32.New(crcTable)
+	crc.Write(hbuf[:bitmapHeaderSize-4])
+	if err := b.encodeChunks(crc, dirtyChunks); err != nil {
+		return err
+	}
+	hdr.checksum = crc.Sum32()
+	hdr.encode(hbuf[:])
+
+	if _, err := w.Write(hbuf[:]); err != nil {
+		return fmt.Errorf("failed to write checkpoint header: %w", err)
+	}
+	if err := b.encodeChunks(w, dirtyChunks); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	b.generation++
+	b.resetDirty(false)
+	return nil
+}
+
+// ApplyCheckpoint reads one checkpoint record from r and applies it. Full
+// images replace the allocator state, incremental records patch it and must
+// build on the generation the state is at, so that a record is never applied
+// to an image it was not written against. It returns io.EOF when r holds no
+// further records.
+func (b *BitmapAllocator) ApplyCheckpoint(r io.Reader) error {
+	var hbuf [bitmapHeaderSize]byte
+	if _, err := io.ReadFull(r, hbuf[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return io.EOF
+		}
+		return fmt.Errorf("failed to read checkpoint header: %w", err)
+	}
+	if binary.LittleEndian.Uint32(hbuf[:]) == bitmapMagic {
+		return b.loadImage(hbuf[:], r)
+	}
+
+	var hdr deltaHeader
+	hdr.decode(hbuf[:])
+	if hdr.magic != bitmapDeltaMagic {
+		return fmt.Errorf("invalid checkpoint magic %#x", hdr.magic)
+	}
+	if hdr.version != bitmapFormatVersion {
+		return fmt.Errorf("unsupported checkpoint format version %d", hdr.version)
+	}
+	if hdr.chunkWords != dirtyChunkWords {
+		return fmt.Errorf("unsupported checkpoint chunk size %d", hdr.chunkWords)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if hdr.base != b.generation {
+		return fmt.Errorf("checkpoint builds on generation %d, bitmap is at generation %d", hdr.base, b.generation)
+	}
+	if hdr.totalSize != b.totalSize {
+		return fmt.Errorf("checkpoint size %d does not match bitmap size %d", hdr.totalSize, b.totalSize)
+	}
+	if hdr.numChunks > b.numChunks() {
+		return fmt.Errorf("checkpoint has %d chunks, bitmap has %d", hdr.numChunks, b.numChunks())
+	}
+
+	// Decode everything before touching level0 so that a corrupt record
+	// leaves the current state intact.
+	crc := crc32.New(crcTable)
+	crc.Write(hbuf[:bitmapHeaderSize-4])
+	tr := io.TeeReader(r, crc)
+	indexes := make([]uint64, hdr.numChunks)
+	chunks := make([][]uint64, hdr.numChunks)
+	var ibuf [unitBytes]byte
+	for i := range indexes {
+		if _, err := io.ReadFull(tr, ibuf[:]); err != nil {
+			return fmt.Errorf("failed to read checkpoint: %w", err)
+		}
+		indexes[i] = binary.LittleEndian.Uint64(ibuf[:])
+		if indexes[i] >= b.numChunks() {
+			return fmt.Errorf("checkpoint chunk %d out of range", indexes[i])
+		}
+		start, end := b.chunkRange(indexes[i])
+		chunks[i] = make([]uint64, end-start)
+		if err := decodeWords(tr, chunks[i]); err != nil {
+			return fmt.Errorf("failed to read checkpoint: %w", err)
+		}
+	}
+	if sum := crc.Sum32(); sum != hdr.checksum {
+		return fmt.Errorf("checkpoint checksum mismatch: got %#x, want %#x", sum, hdr.checksum)
+	}
+
+	for i, chunk := range indexes {
+		start, end := b.chunkRange(chunk)
+		copy(b.level0[start:end], chunks[i])
+		b.updateLevel1(start, end)
+	}
+	b.allocated = hdr.allocated
+	b.generation = hdr.base + 1
+	b.resetDirty(false)
+	return nil
+}
+
+// encodeChunks writes the index and level0 words of each chunk to w
+func (b *BitmapAllocator) encodeChunks(w io.Writer, chunks []uint64) error {
+	var ibuf [unitBytes]byte
+	for _, chunk := range chunks {
+		binary.LittleEndian.PutUint64(ibuf[:], chunk)
+		if _, err := w.Write(ibuf[:]); err != nil {
+			return err
+		}
+		start, end := b.chunkRange(chunk)
+		if err := encodeWords(w, b.level0[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// numChunks returns the number of dirty-tracking chunks covering level0
+func (b *BitmapAllocator) numChunks() uint64 {
+	return (uint64(len(b.level0)) + dirtyChunkWords - 1) / dirtyChunkWords
+}
+
+// chunkRange returns the level0 word range [start, end) of a chunk
+func (b *BitmapAllocator) chunkRange(chunk uint64) (uint64, uint64) {
+	start := chunk * dirtyChunkWords
+	end := start + dirtyChunkWords
+	if end > uint64(len(b.level0)) {
+		end = uint64(len(b.level0))
+	}
+	return start, end
+}
+
+// markDirty records that level0 words [startWord, endWord) were modified
+func (b *BitmapAllocator) markDirty(startWord, endWord uint64) {
+	if endWord > uint64(len(b.level0)) {
+		endWord = uint64(len(b.level0))
+	}
+	if startWord >= endWord {
+		return
+	}
+	for chunk := startWord / dirtyChunkWords; chunk <= (endWord-1)/dirtyChunkWords; chunk++ {
+		b.dirty[chunk/64] |= uint64(1) << (chunk % 64)
+	}
+}
+
+// resetDirty clears the dirty state; full forces the next checkpoint to be
+// a full image
+func (b *BitmapAllocator) resetDirty(full bool) {
+	numDirtyWords := (b.numChunks() + 63) / 64
+	if uint64(len(b.dirty)) != numDirtyWords {
+		b.dirty = make([]uint64, numDirtyWords)
+	} else {
+		for i := range b.dirty {
+			b.dirty[i] = allUnitClear
+		}
+	}
+	b.fullDirty = full
+}
@@ -0,0 +1,207 @@
+package segment
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// checkpointSize spans several dirty chunks of 128 MiB each, so that a few
+// changes make an incremental record
+const checkpointSize = 1<<30 + 5*blockSize
+
+// checkpoint writes a checkpoint of b and checks whether it is a full image
+func checkpoint(t *testing.T, b *BitmapAllocator, full bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := b.Checkpoint(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if magic := binary.LittleEndian.Uint32(buf.Bytes()); (magic == bitmapMagic) != full {
+		t.Fatalf("checkpoint magic is %#x, want a full image: %t", magic, full)
+	}
+	return buf.Bytes()
+}
+
+// applyRecords applies checkpoint records in order until one fails
+func applyRecords(b *BitmapAllocator, records ...[]byte) error {
+	r := bytes.NewReader(slices.Concat(records...))
+	for {
+		if err := b.ApplyCheckpoint(r); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// TestCheckpoint writes a full image and incremental records on top of it
+// and checks that applying them in order recovers every intermediate state
+func TestCheckpoint(t *testing.T) {
+	b := NewBitmapAllocator()
+	b.Init(checkpointSize, blockSize)
+	if _, err := b.AllocateAt(0, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	// Re-initialized allocators write a full image
+	image := checkpoint(t, b, true)
+
+	var records [][]byte
+	var states []*BitmapAllocator
+	for i, r := range []Extent{
+		{Offset: 300 << 20, Size: 64 << 10},
+		{Offset: checkpointSize - 3*blockSize, Size: 3 * blockSize}, // Last, shorter chunk
+		{Offset: 0, Size: 1 << 20},                                  // Freed again
+	} {
+		if i < 2 {
+			if _, err := b.AllocateAt(r.Offset, r.Size); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := b.Free(r.Offset, r.Size); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, checkpoint(t, b, false))
+		var state bytes.Buffer
+		if err := b.Save(&state); err != nil {
+			t.Fatal(err)
+		}
+		loaded := NewBitmapAllocator()
+		if err := loaded.Load(&state); err != nil {
+			t.Fatal(err)
+		}
+		states = append(states, loaded)
+	}
+
+	for i := range records {
+		got := NewBitmapAllocator()
+		if err := applyRecords(got, append([][]byte{image}, records[:i+1]...)...); err != nil {
+			t.Fatal(err)
+		}
+		checkSameState(t, got, states[i])
+	}
+
+	// A checkpoint without changes is an empty incremental record
+	empty := checkpoint(t, b, false)
+	if len(empty) != bitmapHeaderSize {
+		t.Fatalf("checkpoint without changes has %d bytes, want only the header", len(empty))
+	}
+}
+
+// TestCheckpointFullImage checks that a checkpoint with most chunks dirty is
+// written as a full image, which the following records build on
+func TestCheckpointFullImage(t *testing.T) {
+	b := NewBitmapAllocator()
+	b.Init(checkpointSize, blockSize)
+	image := checkpoint(t, b, true)
+	for offset := uint64(0); offset < checkpointSize-1<<20; offset += 128 << 20 {
+		if _, err := b.AllocateAt(offset, blockSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+	full := checkpoint(t, b, true)
+	if _, err := b.AllocateAt(200<<20, blockSize); err != nil {
+		t.Fatal(err)
+	}
+	delta := checkpoint(t, b, false)
+
+	got := NewBitmapAllocator()
+	if err := applyRecords(got, image, full, delta); err != nil {
+		t.Fatal(err)
+	}
+	checkSameState(t, got, b)
+
+	// The full image alone is a starting point too
+	got = NewBitmapAllocator()
+	if err := applyRecords(got, full, delta); err != nil {
+		t.Fatal(err)
+	}
+	checkSameState(t, got, b)
+}
+
+// TestCheckpointGeneration checks that an incremental record only applies
+// to the state it was written against
+func TestCheckpointGeneration(t *testing.T) {
+	b := NewBitmapAllocator()
+	b.Init(checkpointSize, blockSize)
+	image := checkpoint(t, b, true)
+	if _, err := b.AllocateAt(0, blockSize); err != nil {
+		t.Fatal(err)
+	}
+	first := checkpoint(t, b, false)
+	var saved bytes.Buffer
+	if err := b.Save(&saved); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.AllocateAt(512<<20, blockSize); err != nil {
+		t.Fatal(err)
+	}
+	second := checkpoint(t, b, false)
+
+	for _, tt := range []struct {
+		name    string
+		records [][]byte
+	}{
+		{"skipped record", [][]byte{image, second}},
+		{"repeated record", [][]byte{image, first, first}},
+		{"record older than the image", [][]byte{saved.Bytes(), first}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := applyRecords(NewBitmapAllocator(), tt.records...)
+			if err == nil || !strings.Contains(err.Error(), "generation") {
+				t.Fatalf("got %v, want a generation mismatch", err)
+			}
+		})
+	}
+
+	// An image saved between checkpoints takes the records written after it
+	got := NewBitmapAllocator()
+	if err := applyRecords(got, saved.Bytes(), second); err != nil {
+		t.Fatal(err)
+	}
+	checkSameState(t, got, b)
+}
+
+// TestApplyCheckpointDamaged checks that a damaged incremental record is
+// rejected without changing the state it was applied to
+func TestApplyCheckpointDamaged(t *testing.T) {
+	b := NewBitmapAllocator()
+	b.Init(checkpointSize, blockSize)
+	image := checkpoint(t, b, true)
+	if _, err := b.AllocateAt(700<<20, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	delta := checkpoint(t, b, false)
+
+	for _, tt := range []struct {
+		name   string
+		damage func(record []byte) []byte
+		want   string
+	}{
+		{"flipped bit", func(record []byte) []byte {
+			record[len(record)-1] ^= 0x01
+			return record
+		}, "checksum mismatch"},
+		{"truncated", func(record []byte) []byte { return record[:len(record)-8] }, "failed to read checkpoint"},
+		{"chunk out of range", func(record []byte) []byte {
+			binary.LittleEndian.PutUint64(record[bitmapHeaderSize:], 1000)
+			return record
+		}, "out of range"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewBitmapAllocator()
+			if err := applyRecords(got, image); err != nil {
+				t.Fatal(err)
+			}
+			err := got.ApplyCheckpoint(bytes.NewReader(tt.damage(slices.Clone(delta))))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, want an error containing %q", err, tt.want)
+			}
+			if got.GetTotalAllocated() != 0 || got.countAllocated(0, checkpointSize/blockSize) != 0 {
+				t.Fatal("a damaged record changed the allocator")
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package segment
+
+import "math/bits"
+
+// ForEachFreeExtent calls fn for each maximal run of free pages in offset
+// order until fn returns false. fn is called under the read lock and must
+// not call the allocator.
+func (b *BitmapAllocator) ForEachFreeExtent(fn func(offset, length uint64) bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	b.forEachRun(false, func(startBit, numPages uint64) bool {
+		return fn(startBit*uint64(b.pageSize), b.extentLength(startBit, numPages))
+	})
+}
+
+// ForEachAllocatedExtent calls fn for each maximal run of allocated pages in
+// offset order until fn returns false. Adjacent allocations are reported as
+// one extent since the bitmap does not record where one ends. Like
+// ForEachFreeExtent, fn must not call the allocator.
+func (b *BitmapAllocator) ForEachAllocatedExtent(fn func(offset, length uint64) bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	b.forEachRun(true, func(startBit, numPages uint64) bool {
+		return fn(startBit*uint64(b.pageSize), b.extentLength(startBit, numPages))
+	})
+}
+
+// extentLength returns the byte length of a run of pages, clipped to totalSize
+func (b *BitmapAllocator) extentLength(startBit, numPages uint64) uint64 {
+	length := numPages * uint64(b.pageSize)
+	if end := startBit*uint64(b.pageSize) + length; end > b.totalSize {
+		length -= end - b.totalSize
+	}
+	return length
+}
+
+// forEachRun calls fn for each maximal run of allocated or free pages in
+// offset order until fn returns false. Unit sets that level1 marks as the
+// opposite state are skipped whole.
+func (b *BitmapAllocator) forEachRun(allocated bool, fn func(startBit, numPages uint64) bool) {
+	// A trailing partial page has a bit but cannot be allocated, so it is
+	// never part of a free run
+	totalBits := b.totalSize / uint64(b.pageSize)
+	if allocated {
+		totalBits = (b.totalSize + uint64(b.pageSize) - 1) / uint64(b.pageSize)
+	}
+	numWords := uint64(len(b.level0))
+
+	// Runs are tracked over inverted words when looking for allocated pages,
+	// so that clear bits always belong to the run
+	skip, invert := b.level1, uint64(0)
+	if allocated {
+		skip, invert = b.level1Free, allUnitSet
+	}
+
+	var run, runStart uint64
+	emit := func() bool {
+		n := run
+		run = 0
+		if n == 0 || runStart >= totalBits {
+			return true
+		}
+		return fn(runStart, min(n, totalBits-runStart))
+	}
+
+	for wordIdx := uint64(0); wordIdx < numWords; {
+		if wordIdx%unitsPerUnitSet == 0 {
+			unitSet := wordIdx / unitsPerUnitSet
+			if skip[unitSet/64]&(uint64(1)<<(unitSet%64)) != 0 {
+				if !emit() {
+					return
+				}
+				wordIdx += unitsPerUnitSet
+				continue
+			}
+		}
+
+		word := b.level0[wordIdx] ^ invert
+		switch word {
+		case allUnitClear:
+			if run == 0 {
+				runStart = wordIdx * bitsPerUnit
+			}
+			run += bitsPerUnit
+		case allUnitSet:
+			if !emit() {
+				return
+			}
+		default:
+			for bitPos := uint64(0); bitPos < bitsPerUnit; {
+				rest := word >> bitPos
+				n := bitsPerUnit - bitPos
+				if rest != 0 {
+					n = uint64(bits.TrailingZeros64(rest))
+				}
+				if n > 0 {
+					if run == 0 {
+						runStart = wordIdx*bitsPerUnit + bitPos
+					}
+					run += n
+					bitPos += n
+					if bitPos >= bitsPerUnit {
+						break
+					}
+				}
+				if !emit() {
+					return
+				}
+				bitPos += uint64(bits.TrailingZeros64(^(word >> bitPos)))
+			}
+		}
+		wordIdx++
+	}
+	emit()
+}
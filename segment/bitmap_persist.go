@@ -0,0 +1,232 @@
+package segment
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// On-disk format constants
+	bitmapMagic         = 0x504d4253 // "SBMP" in little-endian
+	bitmapFormatVersion = 2
+	bitmapHeaderSize    = 48   // Size of the encoded header in bytes
+	persistChunkWords   = 4096 // Number of level0 words encoded per write
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// bitmapHeader is the fixed-size header written in front of the level0 image.
+// The generation is that of the latest checkpoint the image includes, so
+// that only the incremental records written after it apply on top.
+//
+// Layout (little-endian):
+//
+//	0  magic      uint32
+//	4  version    uint32
+//	8  totalSize  uint64
+//	16 allocated  uint64
+//	24 numWords   uint64
+//	32 generation uint64
+//	40 pageSize   uint32
+//	44 checksum   uint32 (CRC32-C of bytes 0..43 followed by the level0 image)
+type bitmapHeader struct {
+	magic      uint32
+	version    uint32
+	totalSize  uint64
+	allocated  uint64
+	numWords   uint64
+	generation uint64
+	pageSize   uint32
+	checksum   uint32
+}
+
+func (h *bitmapHeader) encode(buf []byte) {
+	binary.LittleEndian.PutUint32(buf[0:], h.magic)
+	binary.LittleEndian.PutUint32(buf[4:], h.version)
+	binary.LittleEndian.PutUint64(buf[8:], h.totalSize)
+	binary.LittleEndian.PutUint64(buf[16:], h.allocated)
+	binary.LittleEndian.PutUint64(buf[24:], h.numWords)
+	binary.LittleEndian.PutUint64(buf[32:], h.generation)
+	binary.LittleEndian.PutUint32(buf[40:], h.pageSize)
+	binary.LittleEndian.PutUint32(buf[44:], h.checksum)
+}
+
+func (h *bitmapHeader) decode(buf []byte) {
+	h.magic = binary.LittleEndian.Uint32(buf[0:])
+	h.version = binary.LittleEndian.Uint32(buf[4:])
+	h.totalSize = binary.LittleEndian.Uint64(buf[8:])
+	h.allocated = binary.LittleEndian.Uint64(buf[16:])
+	h.numWords = binary.LittleEndian.Uint64(buf[24:])
+	h.generation = binary.LittleEndian.Uint64(buf[32:])
+	h.pageSize = binary.LittleEndian.Uint32(buf[40:])
+	h.checksum = binary.LittleEndian.Uint32(buf[44:])
+}
+
+// Save writes the allocator state to w. Only level0 is stored, level1 is
+// derived from it when the image is loaded.
+func (b *BitmapAllocator) Save(w io.Writer) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.save(w)
+}
+
+// save writes a full image to w; the caller must hold b.mu
+func (b *BitmapAllocator) save(w io.Writer) error {
+	hdr := bitmapHeader{
+		magic:      bitmapMagic,
+		version:    bitmapFormatVersion,
+		totalSize:  b.totalSize,
+		allocated:  b.allocated,
+		numWords:   uint64(len(b.level0)),
+		generation: b.generation,
+		pageSize:   b.pageSize,
+	}
+
+	// The checksum is stored in the header, so it has to be computed over
+	// the whole image before anything is written.
+	var hbuf [bitmapHeaderSize]byte
+	hdr.encode(hbuf[:])
+	crc := crc32.New(crcTable)
+	crc.Write(hbuf[:bitmapHeaderSize-4])
+	if err := encodeWords(crc, b.level0); err != nil {
+		return err
+	}
+	hdr.checksum = crc.Sum32()
+	hdr.encode(hbuf[:])
+
+	if _, err := w.Write(hbuf[:]); err != nil {
+		return fmt.Errorf("failed to write bitmap header: %w", err)
+	}
+	if err := encodeWords(w, b.level0); err != nil {
+		return fmt.Errorf("failed to write bitmap: %w", err)
+	}
+	return nil
+}
+
+// Load replaces the allocator state with the image read from r.
+func (b *BitmapAllocator) Load(r io.Reader) error {
+	var hbuf [bitmapHeaderSize]byte
+	if _, err := io.ReadFull(r, hbuf[:]); err != nil {
+		return fmt.Errorf("failed to read bitmap header: %w", err)
+	}
+	return b.loadImage(hbuf[:], r)
+}
+
+// loadImage loads a full image whose header has already been read into hbuf
+func (b *BitmapAllocator) loadImage(hbuf []byte, r io.Reader) error {
+	var hdr bitmapHeader
+	hdr.decode(hbuf)
+
+	if hdr.magic != bitmapMagic {
+		return fmt.Errorf("invalid bitmap magic %#x", hdr.magic)
+	}
+	if hdr.version != bitmapFormatVersion {
+		return fmt.Errorf("unsupported bitmap format version %d", hdr.version)
+	}
+	if hdr.pageSize == 0 {
+		return fmt.Errorf("invalid page size %d", hdr.pageSize)
+	}
+	numBits := (hdr.totalSize + uint64(hdr.pageSize) - 1) / uint64(hdr.pageSize)
+	if hdr.numWords != (numBits+63)/64 {
+		return fmt.Errorf("bitmap size mismatch: %d words for %d bytes", hdr.numWords, hdr.totalSize)
+	}
+	if hdr.allocated > hdr.totalSize {
+		return fmt.Errorf("allocated size %d exceeds total size %d", hdr.allocated, hdr.totalSize)
+	}
+
+	level0 := make([]uint64, hdr.numWords)
+	crc := crc32.New(crcTable)
+	crc.Write(hbuf[:bitmapHeaderSize-4])
+	if err := decodeWords(io.TeeReader(r, crc), level0); err != nil {
+		return fmt.Errorf("failed to read bitmap: %w", err)
+	}
+	if sum := crc.Sum32(); sum != hdr.checksum {
+		return fmt.Errorf("bitmap checksum mismatch: got %#x, want %#x", sum, hdr.checksum)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.totalSize = hdr.totalSize
+	b.pageSize = hdr.pageSize
+	b.allocated = hdr.allocated
+	b.level0 = level0
+	b.generation = hdr.generation
+	b.initLevel1()
+	b.resetDirty(false)
+	return nil
+}
+
+// SaveFile atomically replaces the file at path with the allocator state
+func (b *BitmapAllocator) SaveFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := b.Save(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadFile loads the allocator state from the file at path
+func (b *BitmapAllocator) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return b.Load(f)
+}
+
+// encodeWords writes words to w in little-endian order
+func encodeWords(w io.Writer, words []uint64) error {
+	buf := make([]byte, persistChunkWords*unitBytes)
+	for len(words) > 0 {
+		n := len(words)
+		if n > persistChunkWords {
+			n = persistChunkWords
+		}
+		for i := 0; i < n; i++ {
+			binary.LittleEndian.PutUint64(buf[i*unitBytes:], words[i])
+		}
+		if _, err := w.Write(buf[:n*unitBytes]); err != nil {
+			return err
+		}
+		words = words[n:]
+	}
+	return nil
+}
+
+// decodeWords fills words from little-endian data read from r
+func decodeWords(r io.Reader, words []uint64) error {
+	buf := make([]byte, persistChunkWords*unitBytes)
+	for len(words) > 0 {
+		n := len(words)
+		if n > persistChunkWords {
+			n = persistChunkWords
+		}
+		if _, err := io.ReadFull(r, buf[:n*unitBytes]); err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			words[i] = binary.LittleEndian.Uint64(buf[i*unitBytes:])
+		}
+		words = words[n:]
+	}
+	return nil
+}
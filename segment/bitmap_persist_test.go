@@ -0,0 +1,99 @@
+package segment
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestSaveLoad round-trips fragmented bitmaps, ending in a partial unit set
+// and page, through Save and Load and through SaveFile and LoadFile
+func TestSaveLoad(t *testing.T) {
+	b := fragmentedBitmap(t, 256<<20+3*blockSize+100, 2000)
+
+	var image bytes.Buffer
+	if err := b.Save(&image); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewBitmapAllocator()
+	if err := loaded.Load(&image); err != nil {
+		t.Fatal(err)
+	}
+	checkSameState(t, loaded, b)
+	if loaded.pageSize != b.pageSize {
+		t.Fatalf("loaded page size %d, want %d", loaded.pageSize, b.pageSize)
+	}
+
+	path := filepath.Join(t.TempDir(), "bitmap")
+	if err := b.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+	fromFile := NewBitmapAllocator()
+	if err := fromFile.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	checkSameState(t, fromFile, b)
+
+	// The loaded allocator keeps working where the saved one left off
+	res, err := loaded.Allocate(64 << 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Free(res.Offset, res.Size); err != nil {
+		t.Fatal(err)
+	}
+	checkSameState(t, loaded, b)
+}
+
+// TestLoadRejectsDamagedImage checks that a damaged image is rejected and
+// leaves the allocator it was loaded into as it was
+func TestLoadRejectsDamagedImage(t *testing.T) {
+	b := fragmentedBitmap(t, 64<<20, 200)
+	var buf bytes.Buffer
+	if err := b.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	image := buf.Bytes()
+
+	tests := []struct {
+		name   string
+		damage func(image []byte) []byte
+		want   string
+	}{
+		{"truncated", func(image []byte) []byte { return image[:len(image)-1] }, "failed to read bitmap"},
+		{"truncated header", func(image []byte) []byte { return image[:bitmapHeaderSize/2] }, "failed to read bitmap header"},
+		{"flipped bit", func(image []byte) []byte {
+			image[bitmapHeaderSize+100] ^= 0x10
+			return image
+		}, "checksum mismatch"},
+		{"bad magic", func(image []byte) []byte {
+			binary.LittleEndian.PutUint32(image[0:], 0x12345678)
+			return image
+		}, "invalid bitmap magic"},
+		{"old version", func(image []byte) []byte {
+			binary.LittleEndian.PutUint32(image[4:], 1)
+			return image
+		}, "unsupported bitmap format version"},
+		{"word count", func(image []byte) []byte {
+			binary.LittleEndian.PutUint64(image[24:], 7)
+			return image
+		}, "bitmap size mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := newPagesBitmap(t, 16*blockSize, 3)
+			level0 := slices.Clone(target.level0)
+
+			err := target.Load(bytes.NewReader(tt.damage(slices.Clone(image))))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, want an error containing %q", err, tt.want)
+			}
+			if target.totalSize != 16*blockSize || target.allocated != blockSize || !slices.Equal(target.level0, level0) {
+				t.Fatal("a failed load changed the allocator")
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package segment
+
+import "fmt"
+
+// Reserve allocates space like AllocateNear without journaling it. It is
+// meant for space that is set aside rather than handed out, such as the
+// pre-allocation pool: after a crash, reserved space is free again unless it
+// was committed.
+func (b *BitmapAllocator) Reserve(size, hint uint64) (*Result, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.allocate(size, b.nearest(hint/uint64(b.pageSize)), nil)
+}
+
+// Commit journals a reserved range, rounded up to whole pages, as allocated.
+// Every page in the range must currently be allocated. Without a journal it
+// does nothing, so handing out reserved space never waits for the bitmap.
+func (b *BitmapAllocator) Commit(offset, size uint64) error {
+	return b.journalAllocated(JournalAlloc, offset, size)
+}
+
+// Uncommit journals an allocated range as freed but keeps it allocated,
+// turning it back into a reservation. Without a journal it does nothing.
+func (b *BitmapAllocator) Uncommit(offset, size uint64) error {
+	return b.journalAllocated(JournalFree, offset, size)
+}
+
+// Unreserve frees reserved space like Free without journaling it
+func (b *BitmapAllocator) Unreserve(offset, size uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.free(offset, size, nil)
+}
+
+// journalAllocated appends a record for an allocated range without changing
+// the bitmap. The shared lock is enough since the bitmap is only read and
+// the journal has its own lock; it still orders the record before any
+// Allocate or Free that changes the range afterwards.
+func (b *BitmapAllocator) journalAllocated(op JournalOp, offset, size uint64) error {
+	if b.journal.Load() == nil || size == 0 {
+		return nil
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	// SetJournal holds b.mu exclusively, so the journal cannot change now
+	journal := b.journal.Load()
+	if journal == nil {
+		return nil
+	}
+	if offset%uint64(b.pageSize) != 0 {
+		return fmt.Errorf("%w: %d", ErrMisaligned, offset)
+	}
+	length := bitmapRoundup(size, uint64(b.pageSize))
+	if length < size {
+		return fmt.Errorf("%w: %d bytes at %d", ErrOutOfRange, size, offset)
+	}
+	if offset > b.totalSize || length > b.totalSize-offset {
+		return fmt.Errorf("%w: [%d, %d)", ErrOutOfRange, offset, offset+length)
+	}
+	numPages := length / uint64(b.pageSize)
+	if b.countAllocated(offset/uint64(b.pageSize), numPages) != numPages {
+		return fmt.Errorf("%w: [%d, %d)", ErrDoubleFree, offset, offset+length)
+	}
+
+	_, err := journal.Append(op, offset, length)
+	return err
+}
@@ -0,0 +1,102 @@
+package segment
+
+const (
+	// Resize constants
+	maxBlockingExtents = 16 // Most blocking extents reported by a failed shrink
+)
+
+// Resize changes the managed size to newSize while preserving allocations.
+// Growing adds free space at the end. Shrinking fails with a
+// *ShrinkBlockedError if any page past newSize is allocated. Both levels are
+// resized in place when their capacity allows; the next checkpoint is a full
+// image since the layout changed.
+func (b *BitmapAllocator) Resize(newSize uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if newSize == b.totalSize {
+		return nil
+	}
+	pageSize := uint64(b.pageSize)
+	if newSize < b.totalSize {
+		oldBits := (b.totalSize + pageSize - 1) / pageSize
+		// A partial last page can never be allocated, so it must be free too
+		if err := b.checkTail(newSize, newSize/pageSize, oldBits); err != nil {
+			return err
+		}
+	}
+
+	// Log the resize before applying it
+	if journal := b.journal.Load(); journal != nil {
+		if _, err := journal.Append(JournalResize, 0, newSize); err != nil {
+			return err
+		}
+	}
+	b.resize(newSize)
+	return nil
+}
+
+// resize changes the size of both levels, dropping any pages past newSize;
+// the caller must hold b.mu and account for dropped allocations
+func (b *BitmapAllocator) resize(newSize uint64) {
+	pageSize := uint64(b.pageSize)
+	newBits := (newSize + pageSize - 1) / pageSize
+	oldWords := uint64(len(b.level0))
+	newWords := (newBits + bitsPerUnit - 1) / bitsPerUnit
+	b.level0 = resizeWords(b.level0, newWords)
+	if rem := newBits % bitsPerUnit; rem != 0 {
+		b.level0[newWords-1] &= (uint64(1) << rem) - 1
+	}
+
+	// Clear the summaries of unit sets past the end and recompute the ones
+	// from the old boundary on
+	numUnitSets := (newWords + unitsPerUnitSet - 1) / unitsPerUnitSet
+	numLevel1Words := (numUnitSets + 63) / 64
+	b.level1 = resizeWords(b.level1, numLevel1Words)
+	b.level1Free = resizeWords(b.level1Free, numLevel1Words)
+	if rem := numUnitSets % 64; rem != 0 {
+		mask := (uint64(1) << rem) - 1
+		b.level1[numLevel1Words-1] &= mask
+		b.level1Free[numLevel1Words-1] &= mask
+	}
+	b.updateLevel1(min(oldWords, newWords)/unitsPerUnitSet*unitsPerUnitSet, newWords)
+
+	b.totalSize = newSize
+	if b.cursor >= newBits {
+		b.cursor = 0
+	}
+	b.resetDirty(true)
+}
+
+// checkTail fails with a *ShrinkBlockedError if any page in [startBit,
+// endBit) is allocated; the caller must hold b.mu
+func (b *BitmapAllocator) checkTail(newSize, startBit, endBit uint64) error {
+	if startBit >= endBit || b.countAllocated(startBit, endBit-startBit) == 0 {
+		return nil
+	}
+	err := &ShrinkBlockedError{Size: newSize}
+	b.forEachRun(true, func(runStart, numPages uint64) bool {
+		if runStart+numPages <= startBit {
+			return true
+		}
+		first := max(runStart, startBit)
+		err.BlockingBytes += (runStart + numPages - first) * uint64(b.pageSize)
+		if len(err.Blocking) < maxBlockingExtents {
+			err.Blocking = append(err.Blocking, Extent{
+				Offset: runStart * uint64(b.pageSize),
+				Size:   b.extentLength(runStart, numPages),
+			})
+		}
+		return true
+	})
+	return err
+}
+
+// resizeWords returns words resized to n, reusing its capacity and zeroing
+// any words added at the end
+func resizeWords(words []uint64, n uint64) []uint64 {
+	if old := uint64(len(words)); n > old {
+		return append(words, make([]uint64, n-old)...)
+	}
+	return words[:n]
+}
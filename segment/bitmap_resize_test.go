@@ -0,0 +1,142 @@
+package segment
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// TestResizeGrow grows a bitmap ending in a partial page and unit set and
+// checks that allocations are kept and the new space, including the old
+// partial page, is free
+func TestResizeGrow(t *testing.T) {
+	const oldPages = bitsPerUnitSet + 10
+	b := newPagesBitmap(t, oldPages*blockSize+100, 0, 1, bitsPerUnitSet, oldPages-1)
+	allocated := b.GetTotalAllocated()
+
+	newPages := uint64(3*bitsPerUnitSet + 7)
+	if err := b.Resize(newPages * blockSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.GetTotalAllocated(); got != allocated {
+		t.Fatalf("%d bytes are allocated after growing, want %d", got, allocated)
+	}
+	for _, page := range []uint64{0, 1, bitsPerUnitSet, oldPages - 1} {
+		if b.countAllocated(page, 1) != 1 {
+			t.Fatalf("page %d is no longer allocated after growing", page)
+		}
+	}
+	// The old partial page and everything after it are free
+	if n := b.countAllocated(oldPages, newPages-oldPages); n != 0 {
+		t.Fatalf("%d pages of the new space are allocated", n)
+	}
+	if _, err := b.AllocateAt(oldPages*blockSize, (newPages-oldPages)*blockSize); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestResizeShrinkBlocked checks that a shrink over allocated pages fails,
+// reports the extents in the way and changes nothing
+func TestResizeShrinkBlocked(t *testing.T) {
+	b := newPagesBitmap(t, 32*blockSize, 3, 10, 11, 12, 20)
+	allocated := b.GetTotalAllocated()
+
+	tests := []struct {
+		name          string
+		size          uint64
+		blocking      []Extent
+		blockingBytes uint64
+	}{
+		{"past the extents", 8 * blockSize, []Extent{
+			{Offset: 10 * blockSize, Size: 3 * blockSize},
+			{Offset: 20 * blockSize, Size: blockSize},
+		}, 4 * blockSize},
+		{"through an extent", 11 * blockSize, []Extent{
+			{Offset: 10 * blockSize, Size: 3 * blockSize},
+			{Offset: 20 * blockSize, Size: blockSize},
+		}, 3 * blockSize},
+		{"into a page", 20*blockSize + 1, []Extent{{Offset: 20 * blockSize, Size: blockSize}}, blockSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := b.Resize(tt.size)
+			var shrinkErr *ShrinkBlockedError
+			if !errors.As(err, &shrinkErr) || !errors.Is(err, ErrShrinkBlocked) {
+				t.Fatalf("got %v, want a *ShrinkBlockedError", err)
+			}
+			if !reflect.DeepEqual(shrinkErr.Blocking, tt.blocking) || shrinkErr.BlockingBytes != tt.blockingBytes {
+				t.Fatalf("blocked by %v, %d bytes, want %v, %d bytes",
+					shrinkErr.Blocking, shrinkErr.BlockingBytes, tt.blocking, tt.blockingBytes)
+			}
+			if b.totalSize != 32*blockSize || b.GetTotalAllocated() != allocated {
+				t.Fatal("a blocked shrink changed the allocator")
+			}
+		})
+	}
+}
+
+// TestResizeShrinkPartialPage shrinks to a size that ends inside a page,
+// which is only possible while the page is free and stays unallocatable
+func TestResizeShrinkPartialPage(t *testing.T) {
+	b := newPagesBitmap(t, 16*blockSize, 2, 9)
+	newSize := uint64(9*blockSize + 100)
+	if err := b.Resize(newSize); !errors.Is(err, ErrShrinkBlocked) {
+		t.Fatalf("shrinking over an allocated partial page: got %v, want ErrShrinkBlocked", err)
+	}
+	if err := b.Free(9*blockSize, blockSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Resize(newSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.AllocateAt(9*blockSize, blockSize); !errors.Is(err, ErrOutOfRange) {
+		t.Fatalf("claiming the partial page: got %v, want ErrOutOfRange", err)
+	}
+	if stats := GetFragmentation(b); stats.FreeBytes != 8*blockSize {
+		t.Fatalf("%d bytes are free after shrinking, want 8 pages", stats.FreeBytes)
+	}
+
+	// Growing again makes the page whole
+	if err := b.Resize(16 * blockSize); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.AllocateAt(9*blockSize, blockSize); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestReplayResize checks that resizes are replayed from the journal, so
+// that allocations in grown space and frees before a shrink are recovered
+func TestReplayResize(t *testing.T) {
+	b, image, journal := journaledBitmap(t)
+	if _, err := b.AllocateAt(12<<20, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Free(12<<20, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Resize(8<<20 + 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Resize(48 << 20); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.AllocateAt(40<<20, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Resize(44 << 20); err != nil {
+		t.Fatal(err)
+	}
+
+	got, result := recoverBitmap(t, image, journal.Bytes())
+	if result.Torn || result.Applied != 6 {
+		t.Fatalf("replay result is %+v, want 6 intact records", *result)
+	}
+	checkSameState(t, got, b)
+}
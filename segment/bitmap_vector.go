@@ -0,0 +1,135 @@
+package segment
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// pageRun is a run of pages in level0
+type pageRun struct {
+	startBit uint64 // First page of the run
+	numPages uint64 // Number of pages in the run
+}
+
+// runHeap is a min-heap of runs ordered by length
+type runHeap []pageRun
+
+func (h runHeap) Len() int           { return len(h) }
+func (h runHeap) Less(i, j int) bool { return h[i].numPages < h[j].numPages }
+func (h runHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x any)        { *h = append(*h, x.(pageRun)) }
+func (h *runHeap) Pop() any {
+	old := *h
+	run := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return run
+}
+
+// AllocateVector allocates size bytes as up to maxExtents extents of at
+// least minExtentSize bytes each, except possibly the last one. A single
+// contiguous extent is returned when one exists. A maxExtents of zero means
+// no limit. Nothing is allocated if the request cannot be satisfied.
+func (b *BitmapAllocator) AllocateVector(size uint64, maxExtents int, minExtentSize uint64) (*VectorResult, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if size == 0 {
+		return nil, ErrZeroSize
+	}
+	length := bitmapRoundup(size, uint64(b.pageSize))
+	numPages := length / uint64(b.pageSize)
+	if length < size || length > b.totalSize-b.allocated {
+		return nil, b.spaceError(max(length, size), b.largestFree())
+	}
+	minPages := bitmapRoundup(minExtentSize, uint64(b.pageSize)) / uint64(b.pageSize)
+	if minPages == 0 {
+		minPages = 1
+	}
+
+	var runs []pageRun
+	if startBit, longest := b.findFreeSpace(numPages, 0, 1); startBit != ^uint64(0) {
+		runs = []pageRun{{startBit: startBit, numPages: numPages}}
+	} else {
+		runs = b.pickRuns(numPages, maxExtents, minPages)
+		if runs == nil {
+			return nil, b.spaceError(length, longest)
+		}
+	}
+
+	// Log all extents before applying any of them
+	if journal := b.journal.Load(); journal != nil {
+		for _, run := range runs {
+			if _, err := journal.Append(JournalAlloc, run.startBit*uint64(b.pageSize), run.numPages*uint64(b.pageSize)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	result := &VectorResult{Size: length}
+	for _, run := range runs {
+		b.markAllocated(run.startBit, run.numPages)
+		result.Extents = append(result.Extents, Extent{
+			Offset: run.startBit * uint64(b.pageSize),
+			Size:   run.numPages * uint64(b.pageSize),
+		})
+	}
+	b.allocated += length
+	b.cursor = runs[len(runs)-1].startBit + runs[len(runs)-1].numPages
+	return result, nil
+}
+
+// pickRuns chooses free runs of at least minPages pages adding up to
+// numPages. Runs are first taken in offset order to keep the extents close
+// together; if that needs more than maxExtents runs, the largest runs are
+// used instead. It returns nil when no choice satisfies the request.
+func (b *BitmapAllocator) pickRuns(numPages uint64, maxExtents int, minPages uint64) []pageRun {
+	var runs []pageRun
+	remaining := numPages
+	b.forEachRun(false, func(startBit, n uint64) bool {
+		if n < minPages {
+			return true
+		}
+		n = min(n, remaining)
+		runs = append(runs, pageRun{startBit: startBit, numPages: n})
+		remaining -= n
+		return remaining > 0 && (maxExtents <= 0 || len(runs) < maxExtents)
+	})
+	if remaining == 0 {
+		return runs
+	}
+	if maxExtents <= 0 {
+		return nil
+	}
+
+	// Keep the maxExtents largest runs
+	largest := &runHeap{}
+	b.forEachRun(false, func(startBit, n uint64) bool {
+		if n < minPages {
+			return true
+		}
+		if largest.Len() < maxExtents {
+			heap.Push(largest, pageRun{startBit: startBit, numPages: n})
+		} else if (*largest)[0].numPages < n {
+			(*largest)[0] = pageRun{startBit: startBit, numPages: n}
+			heap.Fix(largest, 0)
+		}
+		return true
+	})
+	candidates := []pageRun(*largest)
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].numPages > candidates[j].numPages })
+
+	runs = runs[:0]
+	remaining = numPages
+	for _, run := range candidates {
+		run.numPages = min(run.numPages, remaining)
+		runs = append(runs, run)
+		remaining -= run.numPages
+		if remaining == 0 {
+			break
+		}
+	}
+	if remaining > 0 {
+		return nil
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].startBit < runs[j].startBit })
+	return runs
+}
@@ -0,0 +1,146 @@
+package segment
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// newPagesBitmap returns a bitmap allocator over size bytes of 4 KiB pages
+// with the listed pages allocated
+func newPagesBitmap(t *testing.T, size uint64, allocated ...uint64) *BitmapAllocator {
+	t.Helper()
+	b := NewBitmapAllocator()
+	b.Init(size, blockSize)
+	for _, page := range allocated {
+		if _, err := b.AllocateAt(page*blockSize, blockSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b
+}
+
+func TestAllocateVector(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       uint64   // Size of the space
+		allocated  []uint64 // Pages allocated beforehand
+		request    uint64
+		maxExtents int
+		minExtent  uint64
+		want       []Extent // nil if the request must fail
+	}{
+		{
+			name:      "contiguous",
+			size:      16 * blockSize,
+			allocated: []uint64{1},
+			request:   3 * blockSize, maxExtents: 4, minExtent: blockSize,
+			want: []Extent{{Offset: 2 * blockSize, Size: 3 * blockSize}},
+		},
+		{
+			name:      "offset order",
+			size:      8 * blockSize,
+			allocated: []uint64{1, 3, 4, 5},
+			request:   4 * blockSize, maxExtents: 4, minExtent: blockSize,
+			want: []Extent{
+				{Offset: 0, Size: blockSize},
+				{Offset: 2 * blockSize, Size: blockSize},
+				{Offset: 6 * blockSize, Size: 2 * blockSize},
+			},
+		},
+		{
+			name:      "largest runs",
+			size:      16 * blockSize,
+			allocated: []uint64{1, 3, 7, 8, 9, 10, 11},
+			request:   6 * blockSize, maxExtents: 2, minExtent: blockSize,
+			want: []Extent{
+				{Offset: 4 * blockSize, Size: 2 * blockSize},
+				{Offset: 12 * blockSize, Size: 4 * blockSize},
+			},
+		},
+		{
+			name:      "minimum extent size",
+			size:      8 * blockSize,
+			allocated: []uint64{1, 3, 4},
+			request:   3 * blockSize, maxExtents: 4, minExtent: 2 * blockSize,
+			want: []Extent{{Offset: 5 * blockSize, Size: 3 * blockSize}},
+		},
+		{
+			name:      "too many extents",
+			size:      8 * blockSize,
+			allocated: []uint64{1, 3, 5, 7},
+			request:   3 * blockSize, maxExtents: 2, minExtent: blockSize,
+		},
+		{
+			// The trailing partial page is not a free page
+			name:      "partial page",
+			size:      8*blockSize + 100,
+			allocated: []uint64{2, 3, 4, 5},
+			request:   3 * blockSize, maxExtents: 1, minExtent: blockSize,
+		},
+		{
+			name:      "partial page split",
+			size:      8*blockSize + 100,
+			allocated: []uint64{2, 3, 4, 5},
+			request:   3 * blockSize, maxExtents: 2, minExtent: blockSize,
+			want: []Extent{
+				{Offset: 0, Size: 2 * blockSize},
+				{Offset: 6 * blockSize, Size: blockSize},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newPagesBitmap(t, tt.size, tt.allocated...)
+			allocated := b.GetTotalAllocated()
+
+			res, err := b.AllocateVector(tt.request, tt.maxExtents, tt.minExtent)
+			if tt.want == nil {
+				var spaceErr *SpaceError
+				if !errors.As(err, &spaceErr) {
+					t.Fatalf("got %v, %v, want a *SpaceError", res, err)
+				}
+				if got := b.GetTotalAllocated(); got != allocated {
+					t.Fatalf("%d bytes are allocated after a failed request, want %d", got, allocated)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(res.Extents, tt.want) || res.Size != tt.request {
+				t.Fatalf("got %v of %d bytes, want %v", res.Extents, res.Size, tt.want)
+			}
+			for _, ext := range res.Extents {
+				if err := b.Free(ext.Offset, ext.Size); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := b.GetTotalAllocated(); got != allocated {
+				t.Fatalf("%d bytes are allocated after freeing the extents, want %d", got, allocated)
+			}
+			if err := b.CheckConsistency(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestForEachFreeExtentPartialPage checks that a trailing partial page is
+// neither reported as free nor counted by GetFragmentation
+func TestForEachFreeExtentPartialPage(t *testing.T) {
+	b := newPagesBitmap(t, 8*blockSize+100, 2, 3, 4, 5)
+
+	var got []Extent
+	b.ForEachFreeExtent(func(offset, length uint64) bool {
+		got = append(got, Extent{Offset: offset, Size: length})
+		return true
+	})
+	want := []Extent{{Offset: 0, Size: 2 * blockSize}, {Offset: 6 * blockSize, Size: 2 * blockSize}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("free extents are %v, want %v", got, want)
+	}
+	if stats := GetFragmentation(b); stats.FreeBytes != 4*blockSize || stats.LargestFree != 2*blockSize {
+		t.Fatalf("fragmentation is %v, want 4 pages free in runs of 2", stats)
+	}
+}
@@ -0,0 +1,303 @@
+package segment
+
+import (
+	"fmt"
+	"math/bits"
+	"sync"
+	"unsafe"
+)
+
+const (
+	// Buddy allocator constants
+	defaultBuddyMaxBlock = 4 << 20 // 4 MiB, the largest request cmd/main generates
+	buddyEntryBytes      = 32      // Approximate memory per free block (slice slot and index entry)
+)
+
+// buddyFreeList is the set of free blocks of one order
+type buddyFreeList struct {
+	offsets []uint64       // Free block offsets
+	index   map[uint64]int // Position of each offset in offsets
+}
+
+func (l *buddyFreeList) push(offset uint64) {
+	l.index[offset] = len(l.offsets)
+	l.offsets = append(l.offsets, offset)
+}
+
+func (l *buddyFreeList) pop() (uint64, bool) {
+	if len(l.offsets) == 0 {
+		return 0, false
+	}
+	offset := l.offsets[len(l.offsets)-1]
+	l.offsets = l.offsets[:len(l.offsets)-1]
+	delete(l.index, offset)
+	return offset, true
+}
+
+func (l *buddyFreeList) remove(offset uint64) bool {
+	i, ok := l.index[offset]
+	if !ok {
+		return false
+	}
+	last := l.offsets[len(l.offsets)-1]
+	l.offsets[i] = last
+	l.index[last] = i
+	l.offsets = l.offsets[:len(l.offsets)-1]
+	delete(l.index, offset)
+	return true
+}
+
+// BuddyAllocator manages space allocation in power-of-two blocks between
+// one page and maxBlock bytes. Requests are rounded up to the next block
+// size, and freed blocks are merged with their free buddies.
+type BuddyAllocator struct {
+	freeLists []buddyFreeList // Free blocks per order, order 0 is one page
+	free      extentTree      // All free blocks by offset, for overlap checks
+	maxBlock  uint64          // Largest block size
+	maxOrder  uint            // Order of the largest block
+	totalSize uint64          // Total size of managed space
+	capacity  uint64          // Total size rounded down to whole pages
+	pageSize  uint32          // Size of each page
+	allocated uint64          // Total allocated space
+	mu        sync.RWMutex
+}
+
+// NewBuddyAllocator creates a new buddy allocator whose largest block is
+// maxBlock bytes, rounded down to a power of two
+func NewBuddyAllocator(maxBlock uint64) *BuddyAllocator {
+	return &BuddyAllocator{
+		free:     extentTree{less: byOffset},
+		maxBlock: maxBlock,
+		pageSize: 4096, // Default page size
+	}
+}
+
+// Init initializes the buddy allocator with the specified size
+func (d *BuddyAllocator) Init(size uint64, pageSize uint32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.totalSize = size
+	d.pageSize = pageSize
+	d.capacity = bitmapAlign(size, uint64(pageSize))
+	d.allocated = 0
+
+	d.maxOrder = 0
+	if pages := d.maxBlock / uint64(pageSize); pages > 1 {
+		d.maxOrder = uint(bits.Len64(pages) - 1)
+	}
+	d.freeLists = make([]buddyFreeList, d.maxOrder+1)
+	for i := range d.freeLists {
+		d.freeLists[i].index = make(map[uint64]int)
+	}
+	d.free.reset()
+
+	// Cover the space with the largest naturally aligned blocks that fit
+	offset := uint64(0)
+	for order := int(d.maxOrder); order >= 0; order-- {
+		blockSize := d.blockSize(uint(order))
+		for offset+blockSize <= d.capacity {
+			d.pushFree(offset, uint(order))
+			offset += blockSize
+		}
+	}
+}
+
+// Allocate allocates a block large enough for size. The result reports the
+// full block size, which is what has to be freed.
+func (d *BuddyAllocator) Allocate(size uint64) (*Result, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if size == 0 {
+		return nil, ErrZeroSize
+	}
+	if size > d.blockSize(d.maxOrder) {
+		return nil, d.spaceError(size)
+	}
+	order := d.orderOf(size)
+
+	// Find the smallest free block that fits and split it down to order
+	for o := order; o <= d.maxOrder; o++ {
+		offset, ok := d.popFree(o)
+		if !ok {
+			continue
+		}
+		for o > order {
+			o--
+			d.pushFree(offset+d.blockSize(o), o)
+		}
+		d.allocated += d.blockSize(order)
+		return &Result{
+			Offset: offset,
+			Size:   d.blockSize(order),
+		}, nil
+	}
+	return nil, d.spaceError(d.blockSize(order))
+}
+
+// spaceError describes why length bytes could not be allocated; the caller
+// must hold d.mu
+func (d *BuddyAllocator) spaceError(length uint64) error {
+	var largest uint64
+	for o := int(d.maxOrder); o >= 0; o-- {
+		if len(d.freeLists[o].offsets) > 0 {
+			largest = d.blockSize(uint(o))
+			break
+		}
+	}
+	return newSpaceError(length, d.capacity-d.allocated, largest)
+}
+
+// Free releases allocated space, rounded up to whole pages. The range does
+// not have to be one block: part of a block, such as a piece carved up by
+// the pre-allocator, or several blocks are freed as the naturally aligned
+// blocks that make them up. Ranges that are misaligned, out of bounds or
+// already free are rejected.
+func (d *BuddyAllocator) Free(offset, size uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if size == 0 {
+		return nil
+	}
+	if offset%uint64(d.pageSize) != 0 {
+		return fmt.Errorf("%w: %d", ErrMisaligned, offset)
+	}
+
+	// Validate the whole range before splitting or freeing any of it: it
+	// must be in bounds, and no free block may enclose, overlap or lie
+	// inside it
+	length := bitmapRoundup(size, uint64(d.pageSize))
+	if length < size || offset > d.capacity || length > d.capacity-offset {
+		return fmt.Errorf("%w: [%d, %d)", ErrOutOfRange, offset, offset+size)
+	}
+	if n := d.free.floor(offset); n != nil && n.end() > offset {
+		return fmt.Errorf("%w: [%d, %d)", ErrDoubleFree, offset, offset+size)
+	}
+	end := offset + length
+	if n := d.free.ceil(offset); n != nil && n.offset < end {
+		return fmt.Errorf("%w: [%d, %d)", ErrDoubleFree, offset, offset+size)
+	}
+
+	// Free the range as the largest naturally aligned blocks
+	for start := offset; start < end; {
+		order := uint(0)
+		for order < d.maxOrder && start%d.blockSize(order+1) == 0 && start+d.blockSize(order+1) <= end {
+			order++
+		}
+		d.freeBlock(start, order)
+		start += d.blockSize(order)
+	}
+	return nil
+}
+
+// freeBlock returns an allocated block to the free lists, merging it with
+// its buddy for as long as that is free; the caller must hold d.mu
+func (d *BuddyAllocator) freeBlock(offset uint64, order uint) {
+	d.allocated -= d.blockSize(order)
+	for order < d.maxOrder {
+		buddy := offset ^ d.blockSize(order)
+		if !d.removeFree(buddy, order) {
+			break
+		}
+		offset = min(offset, buddy)
+		order++
+	}
+	d.pushFree(offset, order)
+}
+
+// pushFree adds a free block of the given order; the caller must hold d.mu
+func (d *BuddyAllocator) pushFree(offset uint64, order uint) {
+	d.freeLists[order].push(offset)
+	d.free.insert(extent{offset: offset, length: d.blockSize(order)})
+}
+
+// popFree takes any free block of the given order; the caller must hold d.mu
+func (d *BuddyAllocator) popFree(order uint) (uint64, bool) {
+	offset, ok := d.freeLists[order].pop()
+	if ok {
+		d.free.remove(extent{offset: offset, length: d.blockSize(order)})
+	}
+	return offset, ok
+}
+
+// removeFree removes a free block of the given order if there is one; the
+// caller must hold d.mu
+func (d *BuddyAllocator) removeFree(offset uint64, order uint) bool {
+	if !d.freeLists[order].remove(offset) {
+		return false
+	}
+	d.free.remove(extent{offset: offset, length: d.blockSize(order)})
+	return true
+}
+
+// GetUtilization returns the current space utilization
+func (d *BuddyAllocator) GetUtilization() float64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.totalSize == 0 {
+		return 0
+	}
+	return float64(d.allocated) / float64(d.totalSize)
+}
+
+// GetTotalAllocated returns the total allocated space
+func (d *BuddyAllocator) GetTotalAllocated() uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.allocated
+}
+
+// GetMemoryUsage returns the approximate memory usage of the free lists and
+// the free block index
+func (d *BuddyAllocator) GetMemoryUsage() uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var entries uint64
+	for i := range d.freeLists {
+		entries += uint64(len(d.freeLists[i].offsets))
+	}
+	return entries*buddyEntryBytes + uint64(d.free.count)*uint64(unsafe.Sizeof(extentNode{}))
+}
+
+// ForEachFreeExtent calls fn for each maximal free extent in offset order
+// until fn returns false. Adjacent free blocks that are not buddies are
+// reported as one extent. fn is called under d.mu and must not call the
+// allocator.
+func (d *BuddyAllocator) ForEachFreeExtent(fn func(offset, length uint64) bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var run extent
+	stopped := false
+	d.free.ascend(func(block extent) bool {
+		if run.length > 0 && run.end() == block.offset {
+			run.length += block.length
+			return true
+		}
+		if run.length > 0 && !fn(run.offset, run.length) {
+			stopped = true
+			return false
+		}
+		run = block
+		return true
+	})
+	if !stopped && run.length > 0 {
+		fn(run.offset, run.length)
+	}
+}
+
+// blockSize returns the size of a block of the given order
+func (d *BuddyAllocator) blockSize(order uint) uint64 {
+	return uint64(d.pageSize) << order
+}
+
+// orderOf returns the smallest order whose blocks hold size bytes
+func (d *BuddyAllocator) orderOf(size uint64) uint {
+	pages := (size + uint64(d.pageSize) - 1) / uint64(d.pageSize)
+	if pages <= 1 {
+		return 0
+	}
+	return uint(bits.Len64(pages - 1))
+}
@@ -0,0 +1,95 @@
+package segment
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrZeroSize is returned when allocating zero bytes
+	ErrZeroSize = errors.New("allocation size is zero")
+	// ErrNoSpace is returned when there is not enough free space in total
+	ErrNoSpace = errors.New("not enough free space")
+	// ErrNoContiguousSpace is returned when there is enough free space in
+	// total but no free extent is large enough
+	ErrNoContiguousSpace = errors.New("not enough contiguous free space")
+	// ErrClosed is returned when using a segment after Close
+	ErrClosed = errors.New("segment is closed")
+	// ErrOutOfRange is returned when a range extends past the managed space
+	ErrOutOfRange = errors.New("range is out of bounds")
+	// ErrMisaligned is returned when an offset is not a multiple of the page size
+	ErrMisaligned = errors.New("offset is not page aligned")
+	// ErrRangeAllocated is returned when claiming a range that is already in use
+	ErrRangeAllocated = errors.New("range is already allocated")
+	// ErrDoubleFree is returned when freeing a range that is not fully allocated
+	ErrDoubleFree = errors.New("range is not allocated")
+	// ErrShrinkBlocked is returned when shrinking would drop allocated space
+	ErrShrinkBlocked = errors.New("allocated space blocks the shrink")
+)
+
+// RangeAllocatedError describes a claim that overlaps allocated space. It
+// matches ErrRangeAllocated with errors.Is.
+type RangeAllocatedError struct {
+	Offset    uint64 // Starting offset of the claimed range
+	Size      uint64 // Length of the claimed range
+	Allocated uint64 // Offset of the first allocated page in the range
+}
+
+func (e *RangeAllocatedError) Error() string {
+	return fmt.Sprintf("range [%d, %d) is already allocated at offset %d",
+		e.Offset, e.Offset+e.Size, e.Allocated)
+}
+
+func (e *RangeAllocatedError) Is(target error) bool {
+	return target == ErrRangeAllocated
+}
+
+// SpaceError describes an allocation that failed for lack of space. It
+// wraps ErrNoSpace or ErrNoContiguousSpace.
+type SpaceError struct {
+	Size        uint64 // Requested size, rounded up to whole pages
+	Free        uint64 // Total free space
+	LargestFree uint64 // Length of the largest free extent
+	Err         error  // ErrNoSpace or ErrNoContiguousSpace
+}
+
+// newSpaceError classifies a failed allocation of size bytes
+func newSpaceError(size, free, largestFree uint64) *SpaceError {
+	err := ErrNoContiguousSpace
+	if size > free {
+		err = ErrNoSpace
+	}
+	return &SpaceError{
+		Size:        size,
+		Free:        free,
+		LargestFree: largestFree,
+		Err:         err,
+	}
+}
+
+func (e *SpaceError) Error() string {
+	return fmt.Sprintf("%v: requested %d bytes, %d bytes free, largest free extent %d bytes",
+		e.Err, e.Size, e.Free, e.LargestFree)
+}
+
+func (e *SpaceError) Unwrap() error {
+	return e.Err
+}
+
+// ShrinkBlockedError lists the allocated extents past the requested size of
+// a shrink. It matches ErrShrinkBlocked with errors.Is.
+type ShrinkBlockedError struct {
+	Size          uint64   // Requested size
+	Blocking      []Extent // First allocated extents reaching past Size, coalesced
+	BlockingBytes uint64   // Total allocated space past Size
+}
+
+func (e *ShrinkBlockedError) Error() string {
+	first := e.Blocking[0]
+	return fmt.Sprintf("cannot shrink to %d bytes: %d allocated bytes past the end, first in extent [%d, %d)",
+		e.Size, e.BlockingBytes, first.Offset, first.Offset+first.Size)
+}
+
+func (e *ShrinkBlockedError) Is(target error) bool {
+	return target == ErrShrinkBlocked
+}
@@ -0,0 +1,201 @@
+package segment
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+// FitPolicy selects which free extent an ExtentAllocator allocates from
+type FitPolicy int
+
+const (
+	FirstFit FitPolicy = iota // Lowest-offset extent that is large enough
+	BestFit                   // Smallest extent that is large enough
+)
+
+// ExtentAllocator manages space allocation using trees of free extents. Free
+// extents are indexed both by offset, for coalescing and first-fit, and by
+// length, for best-fit.
+type ExtentAllocator struct {
+	byOffset  extentTree // Free extents ordered by offset
+	bySize    extentTree // Free extents ordered by length
+	policy    FitPolicy  // Extent selection policy
+	totalSize uint64     // Total size of managed space
+	capacity  uint64     // Total size rounded down to whole pages
+	pageSize  uint32     // Size of each page
+	allocated uint64     // Total allocated space
+	mu        sync.RWMutex
+}
+
+// NewExtentAllocator creates a new extent allocator with the given policy
+func NewExtentAllocator(policy FitPolicy) *ExtentAllocator {
+	return &ExtentAllocator{
+		byOffset: extentTree{less: byOffset},
+		bySize:   extentTree{less: byLength},
+		policy:   policy,
+		pageSize: 4096, // Default page size
+	}
+}
+
+// Init initializes the extent allocator with the specified size
+func (e *ExtentAllocator) Init(size uint64, pageSize uint32) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.totalSize = size
+	e.pageSize = pageSize
+	e.capacity = bitmapAlign(size, uint64(pageSize))
+	e.allocated = 0
+	e.byOffset.reset()
+	e.bySize.reset()
+	if e.capacity > 0 {
+		e.insertFree(extent{offset: 0, length: e.capacity})
+	}
+}
+
+// Allocate allocates space of the specified size
+func (e *ExtentAllocator) Allocate(size uint64) (*Result, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if size == 0 {
+		return nil, ErrZeroSize
+	}
+	length := bitmapRoundup(size, uint64(e.pageSize))
+	if length < size || length > e.capacity-e.allocated {
+		return nil, e.spaceError(max(length, size))
+	}
+
+	var n *extentNode
+	if e.policy == BestFit {
+		n = e.bySize.lowerBound(extent{length: length})
+	} else {
+		n = e.byOffset.firstFit(length)
+	}
+	if n == nil {
+		return nil, e.spaceError(length)
+	}
+
+	// Carve the allocation from the front of the free extent
+	free := n.extent
+	e.removeFree(free)
+	if free.length > length {
+		e.insertFree(extent{offset: free.offset + length, length: free.length - length})
+	}
+	e.allocated += length
+
+	return &Result{
+		Offset: free.offset,
+		Size:   length,
+	}, nil
+}
+
+// spaceError describes why length bytes could not be allocated; the caller
+// must hold e.mu
+func (e *ExtentAllocator) spaceError(length uint64) error {
+	var largest uint64
+	if e.byOffset.root != nil {
+		largest = e.byOffset.root.maxLength
+	}
+	return newSpaceError(length, e.capacity-e.allocated, largest)
+}
+
+// Free releases allocated space. Ranges that are misaligned, out of bounds or
+// overlap free space are rejected.
+func (e *ExtentAllocator) Free(offset, size uint64) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	length := bitmapRoundup(size, uint64(e.pageSize))
+	if size == 0 {
+		return nil
+	}
+	if length < size {
+		return fmt.Errorf("%w: %d bytes at %d", ErrOutOfRange, size, offset)
+	}
+	if offset%uint64(e.pageSize) != 0 {
+		return fmt.Errorf("%w: %d", ErrMisaligned, offset)
+	}
+	if offset > e.capacity || length > e.capacity-offset {
+		return fmt.Errorf("%w: [%d, %d)", ErrOutOfRange, offset, offset+length)
+	}
+	freed := extent{offset: offset, length: length}
+
+	// Refuse ranges that are already partly free. The neighbours are copied
+	// because removing extents may rearrange tree nodes.
+	var prev, next *extent
+	if n := e.byOffset.floor(offset); n != nil {
+		if n.end() > offset {
+			return fmt.Errorf("%w: [%d, %d)", ErrDoubleFree, offset, offset+length)
+		}
+		prev = &extent{offset: n.offset, length: n.length}
+	}
+	if n := e.byOffset.ceil(offset); n != nil {
+		if n.offset < freed.end() {
+			return fmt.Errorf("%w: [%d, %d)", ErrDoubleFree, offset, offset+length)
+		}
+		next = &extent{offset: n.offset, length: n.length}
+	}
+
+	// Coalesce with the neighbouring free extents
+	if prev != nil && prev.end() == offset {
+		e.removeFree(*prev)
+		freed.offset = prev.offset
+		freed.length += prev.length
+	}
+	if next != nil && next.offset == offset+length {
+		e.removeFree(*next)
+		freed.length += next.length
+	}
+	e.insertFree(freed)
+	e.allocated -= length
+	return nil
+}
+
+// GetUtilization returns the current space utilization
+func (e *ExtentAllocator) GetUtilization() float64 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.totalSize == 0 {
+		return 0
+	}
+	return float64(e.allocated) / float64(e.totalSize)
+}
+
+// GetTotalAllocated returns the total allocated space
+func (e *ExtentAllocator) GetTotalAllocated() uint64 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.allocated
+}
+
+// GetMemoryUsage returns the memory usage of the allocator
+func (e *ExtentAllocator) GetMemoryUsage() uint64 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return uint64(e.byOffset.count+e.bySize.count) * uint64(unsafe.Sizeof(extentNode{}))
+}
+
+// ForEachFreeExtent calls fn for each free extent in offset order until fn
+// returns false. fn is called under e.mu and must not call the allocator.
+func (e *ExtentAllocator) ForEachFreeExtent(fn func(offset, length uint64) bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	e.byOffset.ascend(func(free extent) bool {
+		return fn(free.offset, free.length)
+	})
+}
+
+// insertFree adds a free extent to both indexes
+func (e *ExtentAllocator) insertFree(free extent) {
+	e.byOffset.insert(free)
+	e.bySize.insert(free)
+}
+
+// removeFree removes a free extent from both indexes
+func (e *ExtentAllocator) removeFree(free extent) {
+	e.byOffset.remove(free)
+	e.bySize.remove(free)
+}
@@ -0,0 +1,249 @@
+package segment
+
+// extent is a contiguous range of space
+type extent struct {
+	offset uint64 // Starting offset of the range
+	length uint64 // Length of the range
+}
+
+// end returns the offset just past the extent
+func (e extent) end() uint64 {
+	return e.offset + e.length
+}
+
+// extentNode is a node of an AVL tree of extents
+type extentNode struct {
+	extent
+	left      *extentNode
+	right     *extentNode
+	height    int
+	maxLength uint64 // Largest extent length in this subtree
+}
+
+// extentTree is an AVL tree of extents ordered by less. Every node tracks the
+// largest extent length below it, which lets an offset-ordered tree answer
+// first-fit queries in O(log n).
+type extentTree struct {
+	root  *extentNode
+	less  func(a, b extent) bool
+	count int
+}
+
+// byOffset orders extents by starting offset
+func byOffset(a, b extent) bool {
+	return a.offset < b.offset
+}
+
+// byLength orders extents by length, then by starting offset
+func byLength(a, b extent) bool {
+	if a.length != b.length {
+		return a.length < b.length
+	}
+	return a.offset < b.offset
+}
+
+// reset removes all extents from the tree
+func (t *extentTree) reset() {
+	t.root = nil
+	t.count = 0
+}
+
+// insert adds an extent to the tree
+func (t *extentTree) insert(e extent) {
+	t.root = t.insertNode(t.root, e)
+	t.count++
+}
+
+// remove deletes an extent from the tree and reports whether it was present
+func (t *extentTree) remove(e extent) bool {
+	var removed bool
+	t.root = t.removeNode(t.root, e, &removed)
+	if removed {
+		t.count--
+	}
+	return removed
+}
+
+// lowerBound returns the first extent that is not ordered before e
+func (t *extentTree) lowerBound(e extent) *extentNode {
+	var found *extentNode
+	for n := t.root; n != nil; {
+		if t.less(n.extent, e) {
+			n = n.right
+		} else {
+			found = n
+			n = n.left
+		}
+	}
+	return found
+}
+
+// floor returns the last extent starting at or before offset. Only valid
+// for trees ordered by offset.
+func (t *extentTree) floor(offset uint64) *extentNode {
+	var found *extentNode
+	for n := t.root; n != nil; {
+		if n.offset <= offset {
+			found = n
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+	return found
+}
+
+// ceil returns the first extent starting at or after offset. Only valid for
+// trees ordered by offset.
+func (t *extentTree) ceil(offset uint64) *extentNode {
+	var found *extentNode
+	for n := t.root; n != nil; {
+		if n.offset >= offset {
+			found = n
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	return found
+}
+
+// firstFit returns the first extent in tree order whose length is at least
+// length
+func (t *extentTree) firstFit(length uint64) *extentNode {
+	n := t.root
+	for n != nil {
+		if n.left != nil && n.left.maxLength >= length {
+			n = n.left
+		} else if n.length >= length {
+			return n
+		} else if n.right != nil && n.right.maxLength >= length {
+			n = n.right
+		} else {
+			return nil
+		}
+	}
+	return nil
+}
+
+// ascend calls fn for each extent in tree order until fn returns false
+func (t *extentTree) ascend(fn func(e extent) bool) {
+	var stack []*extentNode
+	n := t.root
+	for n != nil || len(stack) > 0 {
+		for n != nil {
+			stack = append(stack, n)
+			n = n.left
+		}
+		n = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !fn(n.extent) {
+			return
+		}
+		n = n.right
+	}
+}
+
+func (t *extentTree) insertNode(n *extentNode, e extent) *extentNode {
+	if n == nil {
+		return &extentNode{extent: e, height: 1, maxLength: e.length}
+	}
+	if t.less(e, n.extent) {
+		n.left = t.insertNode(n.left, e)
+	} else {
+		n.right = t.insertNode(n.right, e)
+	}
+	return rebalance(n)
+}
+
+func (t *extentTree) removeNode(n *extentNode, e extent, removed *bool) *extentNode {
+	if n == nil {
+		return nil
+	}
+	switch {
+	case t.less(e, n.extent):
+		n.left = t.removeNode(n.left, e, removed)
+	case t.less(n.extent, e):
+		n.right = t.removeNode(n.right, e, removed)
+	default:
+		*removed = true
+		if n.left == nil {
+			return n.right
+		}
+		if n.right == nil {
+			return n.left
+		}
+		succ := n.right
+		for succ.left != nil {
+			succ = succ.left
+		}
+		n.extent = succ.extent
+		n.right = removeMin(n.right)
+	}
+	return rebalance(n)
+}
+
+// removeMin deletes the leftmost node of a subtree
+func removeMin(n *extentNode) *extentNode {
+	if n.left == nil {
+		return n.right
+	}
+	n.left = removeMin(n.left)
+	return rebalance(n)
+}
+
+func nodeHeight(n *extentNode) int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+// updateNode recomputes the height and maxLength of a node from its children
+func updateNode(n *extentNode) {
+	n.height = max(nodeHeight(n.left), nodeHeight(n.right)) + 1
+	n.maxLength = n.length
+	if n.left != nil && n.left.maxLength > n.maxLength {
+		n.maxLength = n.left.maxLength
+	}
+	if n.right != nil && n.right.maxLength > n.maxLength {
+		n.maxLength = n.right.maxLength
+	}
+}
+
+func rotateLeft(n *extentNode) *extentNode {
+	r := n.right
+	n.right = r.left
+	r.left = n
+	updateNode(n)
+	updateNode(r)
+	return r
+}
+
+func rotateRight(n *extentNode) *extentNode {
+	l := n.left
+	n.left = l.right
+	l.right = n
+	updateNode(n)
+	updateNode(l)
+	return l
+}
+
+// rebalance restores the AVL invariant at n and returns the new subtree root
+func rebalance(n *extentNode) *extentNode {
+	updateNode(n)
+	balance := nodeHeight(n.left) - nodeHeight(n.right)
+	if balance > 1 {
+		if nodeHeight(n.left.left) < nodeHeight(n.left.right) {
+			n.left = rotateLeft(n.left)
+		}
+		return rotateRight(n)
+	}
+	if balance < -1 {
+		if nodeHeight(n.right.right) < nodeHeight(n.right.left) {
+			n.right = rotateRight(n.right)
+		}
+		return rotateLeft(n)
+	}
+	return n
+}
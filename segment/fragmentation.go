@@ -0,0 +1,64 @@
+package segment
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// FragmentationStats describes how the free space of an allocator is split
+// into extents
+type FragmentationStats struct {
+	FreeBytes   uint64     // Total free space
+	FreeExtents uint64     // Number of maximal free extents
+	LargestFree uint64     // Length of the largest free extent
+	Histogram   [64]uint64 // Free extents by size, bucket i holds lengths in [2^i, 2^(i+1))
+	Score       float64    // 1 - LargestFree/FreeBytes, 0 when unfragmented or full
+}
+
+// GetFragmentation walks the free extents of an allocator and summarizes
+// them. The score is 0 when all free space is one extent and approaches 1 as
+// the free space is scattered over many small extents.
+func GetFragmentation(a Allocator) *FragmentationStats {
+	stats := &FragmentationStats{}
+	a.ForEachFreeExtent(func(offset, length uint64) bool {
+		if length == 0 {
+			return true
+		}
+		stats.FreeBytes += length
+		stats.FreeExtents++
+		stats.LargestFree = max(stats.LargestFree, length)
+		stats.Histogram[bits.Len64(length)-1]++
+		return true
+	})
+	if stats.FreeBytes > 0 {
+		stats.Score = 1 - float64(stats.LargestFree)/float64(stats.FreeBytes)
+	}
+	return stats
+}
+
+// String returns the summary and the non-empty histogram buckets
+func (f *FragmentationStats) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "free=%d extents=%d largest=%d score=%.4f histogram=[",
+		f.FreeBytes, f.FreeExtents, f.LargestFree, f.Score)
+	first := true
+	for i, count := range f.Histogram {
+		if count == 0 {
+			continue
+		}
+		if !first {
+			sb.WriteString(" ")
+		}
+		first = false
+		fmt.Fprintf(&sb, "%s:%d", formatPow2(i), count)
+	}
+	sb.WriteString("]")
+	return sb.String()
+}
+
+// formatPow2 formats 2^exp bytes with a binary unit suffix
+func formatPow2(exp int) string {
+	units := []string{"B", "K", "M", "G", "T", "P", "E"}
+	return fmt.Sprintf("%d%s", uint64(1)<<(exp%10), units[exp/10])
+}
@@ -0,0 +1,37 @@
+package segment
+
+import "testing"
+
+func TestGetFragmentation(t *testing.T) {
+	tests := []struct {
+		name      string
+		allocated []uint64 // Pages allocated in a 16-page space
+		extents   uint64
+		largest   uint64   // Pages
+		histogram []uint64 // Counts from the 4 KiB bucket up
+		score     float64
+		summary   string
+	}{
+		{"empty", nil, 1, 16, []uint64{0, 0, 0, 0, 1}, 0,
+			"free=65536 extents=1 largest=65536 score=0.0000 histogram=[64K:1]"},
+		{"fragmented", []uint64{1, 4, 5, 9}, 4, 6, []uint64{1, 2, 1}, 0.5,
+			"free=49152 extents=4 largest=24576 score=0.5000 histogram=[4K:1 8K:2 16K:1]"},
+		{"full", []uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}, 0, 0, nil, 0,
+			"free=0 extents=0 largest=0 score=0.0000 histogram=[]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := GetFragmentation(newPagesBitmap(t, 16*blockSize, tt.allocated...))
+			var histogram [64]uint64
+			copy(histogram[12:], tt.histogram)
+			free := (16 - uint64(len(tt.allocated))) * blockSize
+			if stats.FreeBytes != free || stats.FreeExtents != tt.extents || stats.LargestFree != tt.largest*blockSize ||
+				stats.Histogram != histogram || stats.Score != tt.score {
+				t.Fatalf("got %v, want %s", stats, tt.summary)
+			}
+			if got := stats.String(); got != tt.summary {
+				t.Fatalf("summary is %q, want %q", got, tt.summary)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package segment
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+const (
+	// Default memory budget for the free extent trees of a HybridAllocator
+	defaultHybridBudget = 1 << 20 // 1 MiB
+)
+
+// HybridAllocator keeps free extents in trees while they fit in a memory
+// budget and spills the smallest ones into a bitmap beyond it. Contiguous free
+// space costs a handful of tree nodes, heavily fragmented free space costs at
+// most the fixed size of the bitmap.
+//
+// Every free page is tracked by exactly one side: either it is part of a tree
+// extent, or its bit is clear in the bitmap. Tree extents are never adjacent
+// to free bitmap pages because Free absorbs such pages into the tree.
+type HybridAllocator struct {
+	byOffset  extentTree       // Tree-held free extents ordered by offset
+	bySize    extentTree       // Tree-held free extents ordered by length
+	bitmap    *BitmapAllocator // Spilled free space, created on first spill
+	budget    uint64           // Memory budget for the trees in bytes
+	totalSize uint64           // Total size of managed space
+	capacity  uint64           // Total size rounded down to whole pages
+	pageSize  uint32           // Size of each page
+	allocated uint64           // Total allocated space
+	mu        sync.RWMutex
+}
+
+// NewHybridAllocator creates a new hybrid allocator whose extent trees may
+// use up to budget bytes of memory
+func NewHybridAllocator(budget uint64) *HybridAllocator {
+	return &HybridAllocator{
+		byOffset: extentTree{less: byOffset},
+		bySize:   extentTree{less: byLength},
+		budget:   budget,
+		pageSize: 4096, // Default page size
+	}
+}
+
+// Init initializes the hybrid allocator with the specified size
+func (h *HybridAllocator) Init(size uint64, pageSize uint32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.totalSize = size
+	h.pageSize = pageSize
+	h.capacity = bitmapAlign(size, uint64(pageSize))
+	h.allocated = 0
+	h.bitmap = nil
+	h.byOffset.reset()
+	h.bySize.reset()
+	if h.capacity > 0 {
+		h.insertFree(extent{offset: 0, length: h.capacity})
+	}
+}
+
+// Allocate allocates space of the specified size, preferring tree-held
+// extents and falling back to the bitmap
+func (h *HybridAllocator) Allocate(size uint64) (*Result, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if size == 0 {
+		return nil, ErrZeroSize
+	}
+	length := bitmapRoundup(size, uint64(h.pageSize))
+	if length < size || length > h.capacity-h.allocated {
+		return nil, h.spaceError(max(length, size))
+	}
+
+	if n := h.bySize.lowerBound(extent{length: length}); n != nil {
+		free := n.extent
+		h.removeFree(free)
+		if free.length > length {
+			h.insertFree(extent{offset: free.offset + length, length: free.length - length})
+		}
+		h.allocated += length
+		return &Result{
+			Offset: free.offset,
+			Size:   length,
+		}, nil
+	}
+
+	if h.bitmap != nil {
+		if result, err := h.bitmap.Allocate(length); err == nil {
+			h.allocated += length
+			return result, nil
+		}
+	}
+	return nil, h.spaceError(length)
+}
+
+// spaceError describes why length bytes could not be allocated. The trees
+// and the bitmap are read together under h.mu, so the largest free extent is
+// the one at the failure. The caller must hold h.mu.
+func (h *HybridAllocator) spaceError(length uint64) error {
+	var largest uint64
+	if h.byOffset.root != nil {
+		largest = h.byOffset.root.maxLength
+	}
+	if h.bitmap != nil {
+		h.bitmap.mu.RLock()
+		largest = max(largest, h.bitmap.largestFree()*uint64(h.bitmap.pageSize))
+		h.bitmap.mu.RUnlock()
+	}
+	return newSpaceError(length, h.capacity-h.allocated, largest)
+}
+
+// Free releases allocated space. Ranges that are misaligned, out of bounds or
+// overlap free space are rejected.
+func (h *HybridAllocator) Free(offset, size uint64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	length := bitmapRoundup(size, uint64(h.pageSize))
+	if size == 0 {
+		return nil
+	}
+	if length < size {
+		return fmt.Errorf("%w: %d bytes at %d", ErrOutOfRange, size, offset)
+	}
+	if offset%uint64(h.pageSize) != 0 {
+		return fmt.Errorf("%w: %d", ErrMisaligned, offset)
+	}
+	if offset > h.capacity || length > h.capacity-offset {
+		return fmt.Errorf("%w: [%d, %d)", ErrOutOfRange, offset, offset+length)
+	}
+	freed := extent{offset: offset, length: length}
+
+	// Refuse ranges that are already partly free on either side
+	var prev, next *extent
+	if n := h.byOffset.floor(offset); n != nil {
+		if n.end() > offset {
+			return fmt.Errorf("%w: [%d, %d)", ErrDoubleFree, offset, offset+length)
+		}
+		prev = &extent{offset: n.offset, length: n.length}
+	}
+	if n := h.byOffset.ceil(offset); n != nil {
+		if n.offset < freed.end() {
+			return fmt.Errorf("%w: [%d, %d)", ErrDoubleFree, offset, offset+length)
+		}
+		next = &extent{offset: n.offset, length: n.length}
+	}
+	pageSize := uint64(h.pageSize)
+	if h.bitmap != nil && h.bitmap.countAllocated(offset/pageSize, length/pageSize) != length/pageSize {
+		return fmt.Errorf("%w: [%d, %d)", ErrDoubleFree, offset, offset+length)
+	}
+
+	// Coalesce with the neighbouring free space, from the trees or the bitmap
+	if prev != nil && prev.end() == offset {
+		h.removeFree(*prev)
+		freed.offset = prev.offset
+		freed.length += prev.length
+	} else if h.bitmap != nil {
+		start := offset / pageSize
+		for start > 0 && h.bitmapFree(start-1) {
+			start--
+		}
+		h.claimBitmap(start, offset/pageSize-start)
+		freed.offset = start * pageSize
+		freed.length += offset - freed.offset
+	}
+	if next != nil && next.offset == offset+length {
+		h.removeFree(*next)
+		freed.length += next.length
+	} else if h.bitmap != nil {
+		start := (offset + length) / pageSize
+		end := start
+		for end < h.capacity/pageSize && h.bitmapFree(end) {
+			end++
+		}
+		h.claimBitmap(start, end-start)
+		freed.length += (end - start) * pageSize
+	}
+	h.insertFree(freed)
+	h.allocated -= length
+	h.spill()
+	return nil
+}
+
+// GetUtilization returns the current space utilization
+func (h *HybridAllocator) GetUtilization() float64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.totalSize == 0 {
+		return 0
+	}
+	return float64(h.allocated) / float64(h.totalSize)
+}
+
+// GetTotalAllocated returns the total allocated space
+func (h *HybridAllocator) GetTotalAllocated() uint64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.allocated
+}
+
+// GetMemoryUsage returns the memory used by the trees and, once created,
+// the bitmap
+func (h *HybridAllocator) GetMemoryUsage() uint64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	usage := h.treeMemory()
+	if h.bitmap != nil {
+		usage += h.bitmap.GetMemoryUsage()
+	}
+	return usage
+}
+
+// ForEachFreeExtent calls fn for each free extent in offset order until fn
+// returns false. fn is called under h.mu and the bitmap's lock and must not
+// call the allocator.
+func (h *HybridAllocator) ForEachFreeExtent(fn func(offset, length uint64) bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var held []extent
+	h.byOffset.ascend(func(free extent) bool {
+		held = append(held, free)
+		return true
+	})
+
+	// Merge the tree-held extents with the spilled ones in offset order
+	stopped := false
+	if h.bitmap != nil {
+		h.bitmap.ForEachFreeExtent(func(offset, length uint64) bool {
+			for len(held) > 0 && held[0].offset < offset {
+				if !fn(held[0].offset, held[0].length) {
+					stopped = true
+					return false
+				}
+				held = held[1:]
+			}
+			if !fn(offset, length) {
+				stopped = true
+				return false
+			}
+			return true
+		})
+	}
+	for _, free := range held {
+		if stopped || !fn(free.offset, free.length) {
+			return
+		}
+	}
+}
+
+// spill moves the smallest tree-held extents into the bitmap until the trees
+// fit in the memory budget again
+func (h *HybridAllocator) spill() {
+	for h.treeMemory() > h.budget && h.bySize.count > 0 {
+		if h.bitmap == nil {
+			h.bitmap = NewBitmapAllocator()
+			h.bitmap.Init(h.totalSize, h.pageSize)
+			h.bitmap.fillAllocated()
+		}
+		smallest := h.bySize.lowerBound(extent{}).extent
+		h.removeFree(smallest)
+		h.bitmap.Free(smallest.offset, smallest.length)
+	}
+}
+
+// treeMemory returns the memory used by the free extent trees
+func (h *HybridAllocator) treeMemory() uint64 {
+	return uint64(h.byOffset.count+h.bySize.count) * uint64(unsafe.Sizeof(extentNode{}))
+}
+
+// bitmapFree reports whether a page is free in the bitmap
+func (h *HybridAllocator) bitmapFree(bit uint64) bool {
+	return h.bitmap.level0[bit/64]&(uint64(1)<<(bit%64)) == 0
+}
+
+// claimBitmap marks spilled pages as allocated in the bitmap so that they
+// can be merged into a tree-held extent. h.mu serializes all bitmap access.
+func (h *HybridAllocator) claimBitmap(startBit, numPages uint64) {
+	if numPages == 0 {
+		return
+	}
+	h.bitmap.markAllocated(startBit, numPages)
+	h.bitmap.allocated += numPages * uint64(h.pageSize)
+}
+
+// insertFree adds a free extent to both trees
+func (h *HybridAllocator) insertFree(free extent) {
+	h.byOffset.insert(free)
+	h.bySize.insert(free)
+}
+
+// removeFree removes a free extent from both trees
+func (h *HybridAllocator) removeFree(free extent) {
+	h.byOffset.remove(free)
+	h.bySize.remove(free)
+}
@@ -0,0 +1,242 @@
+package segment
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	// Journal record constants
+	journalRecordSize = 32 // Size of an encoded journal record in bytes
+)
+
+// JournalOp is the kind of operation recorded in the journal
+type JournalOp uint8
+
+const (
+	JournalAlloc  JournalOp = 1 // Range was allocated
+	JournalFree   JournalOp = 2 // Range was freed
+	JournalResize JournalOp = 3 // Managed size changed to Length
+)
+
+// JournalRecord is a single allocation or free operation.
+//
+// Layout (little-endian):
+//
+//	0  seq    uint64
+//	8  offset uint64
+//	16 length uint64
+//	24 op     uint8
+//	25 pad    [3]byte
+//	28 crc    uint32 (CRC32-C of bytes 0..27)
+type JournalRecord struct {
+	Seq    uint64    // Sequence number, increasing by one per record
+	Op     JournalOp // Operation kind
+	Offset uint64    // Starting offset of the range
+	Length uint64    // Length of the range
+}
+
+func (rec *JournalRecord) encode(buf []byte) {
+	binary.LittleEndian.PutUint64(buf[0:], rec.Seq)
+	binary.LittleEndian.PutUint64(buf[8:], rec.Offset)
+	binary.LittleEndian.PutUint64(buf[16:], rec.Length)
+	buf[24] = byte(rec.Op)
+	buf[25], buf[26], buf[27] = 0, 0, 0
+	binary.LittleEndian.PutUint32(buf[28:], crc32.Checksum(buf[:28], crcTable))
+}
+
+// decode fills rec from buf and reports whether the record is intact
+func (rec *JournalRecord) decode(buf []byte) bool {
+	if binary.LittleEndian.Uint32(buf[28:]) != crc32.Checksum(buf[:28], crcTable) {
+		return false
+	}
+	rec.Seq = binary.LittleEndian.Uint64(buf[0:])
+	rec.Offset = binary.LittleEndian.Uint64(buf[8:])
+	rec.Length = binary.LittleEndian.Uint64(buf[16:])
+	rec.Op = JournalOp(buf[24])
+	return rec.Op == JournalAlloc || rec.Op == JournalFree || rec.Op == JournalResize
+}
+
+// Journal is a write-ahead log of allocator operations between checkpoints
+type Journal struct {
+	w   io.Writer
+	seq uint64 // Sequence number of the next record
+	err error  // First write error, returned by all later appends
+	buf [journalRecordSize]byte
+	mu  sync.Mutex
+}
+
+// NewJournal creates a journal appending to w, numbering records from nextSeq
+func NewJournal(w io.Writer, nextSeq uint64) *Journal {
+	return &Journal{
+		w:   w,
+		seq: nextSeq,
+	}
+}
+
+// Append writes a record and returns its sequence number
+func (j *Journal) Append(op JournalOp, offset, length uint64) (uint64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.err != nil {
+		return 0, j.err
+	}
+	rec := JournalRecord{
+		Seq:    j.seq,
+		Op:     op,
+		Offset: offset,
+		Length: length,
+	}
+	rec.encode(j.buf[:])
+	if _, err := j.w.Write(j.buf[:]); err != nil {
+		j.err = fmt.Errorf("failed to append journal record %d: %w", rec.Seq, err)
+		return 0, j.err
+	}
+	j.seq++
+	return rec.Seq, nil
+}
+
+// NextSeq returns the sequence number of the next record
+func (j *Journal) NextSeq() uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.seq
+}
+
+// Err returns the first error encountered while appending
+func (j *Journal) Err() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.err
+}
+
+// Sync flushes and syncs the underlying writer if it supports it
+func (j *Journal) Sync() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.err != nil {
+		return j.err
+	}
+	if f, ok := j.w.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	if f, ok := j.w.(interface{ Sync() error }); ok {
+		return f.Sync()
+	}
+	return nil
+}
+
+// ReplayResult describes the outcome of a journal replay
+type ReplayResult struct {
+	Applied   int    // Number of records applied
+	ValidSize int64  // Length of the intact journal prefix in bytes
+	NextSeq   uint64 // Sequence number to continue the journal with
+	Torn      bool   // Whether a torn or corrupt tail was found
+}
+
+// Replay applies the records in r on top of the current state, stopping at
+// the first torn, corrupt, out-of-order or out-of-range record. Records set
+// or clear page ranges absolutely, so replaying a journal over a checkpoint
+// that already contains some of its records yields the same state.
+func (b *BitmapAllocator) Replay(r io.Reader) (*ReplayResult, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	result := &ReplayResult{}
+	var buf [journalRecordSize]byte
+	for {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				result.Torn = true
+				break
+			}
+			if err == io.EOF {
+				break
+			}
+			return result, fmt.Errorf("failed to read journal: %w", err)
+		}
+
+		var rec JournalRecord
+		if !rec.decode(buf[:]) ||
+			(result.Applied > 0 && rec.Seq != result.NextSeq) ||
+			rec.Offset%uint64(b.pageSize) != 0 ||
+			(rec.Op != JournalResize && (rec.Offset > b.totalSize || rec.Length > b.totalSize-rec.Offset)) {
+			result.Torn = true
+			break
+		}
+
+		if rec.Op == JournalResize {
+			b.replayResize(rec.Length)
+		} else {
+			startBit := rec.Offset / uint64(b.pageSize)
+			numPages := (rec.Length + uint64(b.pageSize) - 1) / uint64(b.pageSize)
+			used := b.countAllocated(startBit, numPages)
+			if rec.Op == JournalAlloc {
+				b.markAllocated(startBit, numPages)
+				b.allocated += (numPages - used) * uint64(b.pageSize)
+			} else {
+				b.markFree(startBit, numPages)
+				b.releaseAllocated(used * uint64(b.pageSize))
+			}
+		}
+
+		result.Applied++
+		result.ValidSize += journalRecordSize
+		result.NextSeq = rec.Seq + 1
+	}
+	return result, nil
+}
+
+// replayResize applies a resize record. Pages past the new size are dropped
+// even if allocated, since later records in the journal restore any state
+// that outlived the resize.
+func (b *BitmapAllocator) replayResize(newSize uint64) {
+	pageSize := uint64(b.pageSize)
+	oldBits := (b.totalSize + pageSize - 1) / pageSize
+	if startBit := (newSize + pageSize - 1) / pageSize; startBit < oldBits {
+		b.releaseAllocated(b.countAllocated(startBit, oldBits-startBit) * pageSize)
+	}
+	b.resize(newSize)
+}
+
+// releaseAllocated lowers the allocated total without underflowing
+func (b *BitmapAllocator) releaseAllocated(length uint64) {
+	if b.allocated >= length {
+		b.allocated -= length
+	} else {
+		b.allocated = 0
+	}
+}
+
+// RecoverJournal replays the journal file at path and truncates any torn or
+// corrupt tail so that new records can be appended after the intact prefix
+func (b *BitmapAllocator) RecoverJournal(path string) (*ReplayResult, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	result, err := b.Replay(f)
+	if err != nil {
+		return result, err
+	}
+	if result.Torn {
+		if err := f.Truncate(result.ValidSize); err != nil {
+			return result, fmt.Errorf("failed to truncate journal: %w", err)
+		}
+		if err := f.Sync(); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
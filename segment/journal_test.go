@@ -0,0 +1,271 @@
+package segment
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// journaledBitmap returns a bitmap allocator over 16 MiB, the image it was
+// saved to and the journal it appends to from then on
+func journaledBitmap(t *testing.T) (*BitmapAllocator, []byte, *bytes.Buffer) {
+	t.Helper()
+	b := NewBitmapAllocator()
+	b.Init(16<<20, blockSize)
+	var image bytes.Buffer
+	if err := b.Save(&image); err != nil {
+		t.Fatal(err)
+	}
+	journal := &bytes.Buffer{}
+	b.SetJournal(NewJournal(journal, 0))
+	return b, image.Bytes(), journal
+}
+
+// recoverBitmap loads image and replays journal on top of it, like
+// recovery after a crash
+func recoverBitmap(t *testing.T, image, journal []byte) (*BitmapAllocator, *ReplayResult) {
+	t.Helper()
+	b := NewBitmapAllocator()
+	if err := b.Load(bytes.NewReader(image)); err != nil {
+		t.Fatal(err)
+	}
+	result, err := b.Replay(bytes.NewReader(journal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, result
+}
+
+// checkSameState fails unless both allocators have the same size, pages
+// and allocated total
+func checkSameState(t *testing.T, got, want *BitmapAllocator) {
+	t.Helper()
+	if got.totalSize != want.totalSize || got.allocated != want.allocated || !slices.Equal(got.level0, want.level0) {
+		t.Fatalf("recovered %d bytes with %d allocated, want %d bytes with %d allocated or different pages",
+			got.totalSize, got.allocated, want.totalSize, want.allocated)
+	}
+	if err := got.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// journalOps runs a fixed mix of journaled operations, one record each
+func journalOps(t *testing.T, b *BitmapAllocator) {
+	t.Helper()
+	a, err := b.Allocate(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.AllocateAt(8<<20, 3*blockSize); err != nil {
+		t.Fatal(err)
+	}
+	c, err := b.AllocateNear(64<<10, 4<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Free(a.Offset, a.Size/2); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Resize(32 << 20); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.AllocateAt(20<<20, blockSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Free(c.Offset, c.Size); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	b, image, journal := journaledBitmap(t)
+	journalOps(t, b)
+	records := journal.Len() / journalRecordSize
+
+	got, result := recoverBitmap(t, image, journal.Bytes())
+	checkSameState(t, got, b)
+	want := ReplayResult{Applied: records, ValidSize: int64(records * journalRecordSize), NextSeq: uint64(records)}
+	if *result != want {
+		t.Fatalf("replay result is %+v, want %+v", *result, want)
+	}
+}
+
+// TestReplayTorn cuts or corrupts the journal and checks that replay stops
+// at the last intact record with the state that record left behind
+func TestReplayTorn(t *testing.T) {
+	b, image, journal := journaledBitmap(t)
+	journalOps(t, b)
+	records := journal.Len() / journalRecordSize
+	full := journal.Bytes()
+
+	tests := []struct {
+		name    string
+		journal func() []byte
+		intact  int // Records before the damage
+	}{
+		{"torn tail", func() []byte { return full[:len(full)-10] }, records - 1},
+		{"corrupt record", func() []byte {
+			damaged := slices.Clone(full)
+			damaged[3*journalRecordSize+9] ^= 0x40
+			return damaged
+		}, 3},
+		{"repeated record", func() []byte {
+			return slices.Concat(full[:3*journalRecordSize], full[2*journalRecordSize:])
+		}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, result := recoverBitmap(t, image, tt.journal())
+			want, _ := recoverBitmap(t, image, full[:tt.intact*journalRecordSize])
+			checkSameState(t, got, want)
+			if !result.Torn || result.Applied != tt.intact || result.ValidSize != int64(tt.intact*journalRecordSize) ||
+				result.NextSeq != uint64(tt.intact) {
+				t.Fatalf("replay result is %+v, want a torn journal with %d intact records", *result, tt.intact)
+			}
+		})
+	}
+}
+
+// TestReplayIdempotent replays a journal over an image that already holds
+// some of its records, and twice over the same allocator
+func TestReplayIdempotent(t *testing.T) {
+	b, image, journal := journaledBitmap(t)
+	if _, err := b.AllocateAt(0, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Free(0, 64<<10); err != nil {
+		t.Fatal(err)
+	}
+	var later bytes.Buffer
+	if err := b.Save(&later); err != nil {
+		t.Fatal(err)
+	}
+	journalOps(t, b)
+
+	for _, base := range [][]byte{image, later.Bytes()} {
+		got, _ := recoverBitmap(t, base, journal.Bytes())
+		checkSameState(t, got, b)
+		if _, err := got.Replay(bytes.NewReader(journal.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		checkSameState(t, got, b)
+	}
+}
+
+// TestRecoverJournal checks that a torn tail is truncated so that records
+// appended after recovery are replayed too
+func TestRecoverJournal(t *testing.T) {
+	b, image, journal := journaledBitmap(t)
+	journalOps(t, b)
+	records := journal.Len() / journalRecordSize
+	path := filepath.Join(t.TempDir(), "journal")
+	torn := append(slices.Clone(journal.Bytes()), garbage(journalRecordSize/2)...)
+	if err := os.WriteFile(path, torn, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, _ := recoverBitmap(t, image, nil)
+	result, err := recovered.RecoverJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Torn || result.Applied != records {
+		t.Fatalf("replay result is %+v, want a torn journal with %d records", *result, records)
+	}
+	checkSameState(t, recovered, b)
+	if info, err := os.Stat(path); err != nil || info.Size() != result.ValidSize {
+		t.Fatalf("journal was not truncated to %d bytes: %v, %v", result.ValidSize, info.Size(), err)
+	}
+
+	// Continue the journal where the intact prefix ends
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovered.SetJournal(NewJournal(f, result.NextSeq))
+	if _, err := recovered.AllocateAt(24<<20, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, result := recoverBitmap(t, image, data)
+	checkSameState(t, got, recovered)
+	if result.Torn || result.Applied != records+1 {
+		t.Fatalf("replay result is %+v, want %d intact records", *result, records+1)
+	}
+}
+
+// garbage returns n bytes of 0xff, which never form an intact record
+func garbage(n int) []byte {
+	return bytes.Repeat([]byte{0xff}, n)
+}
+
+// TestReplayReservations checks that only committed space survives a
+// crash: reservations that were never committed, or were uncommitted, are
+// free again after recovery
+func TestReplayReservations(t *testing.T) {
+	b, image, journal := journaledBitmap(t)
+	committed, err := b.Reserve(1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(committed.Offset, committed.Size); err != nil {
+		t.Fatal(err)
+	}
+	reserved, err := b.Reserve(2<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	returned, err := b.Reserve(64<<10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(returned.Offset, returned.Size); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Uncommit(returned.Offset, returned.Size); err != nil {
+		t.Fatal(err)
+	}
+	allocated, err := b.Allocate(4 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreserved, err := b.Reserve(128<<10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Unreserve(unreserved.Offset, unreserved.Size); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := recoverBitmap(t, image, journal.Bytes())
+	if want := committed.Size + allocated.Size; got.GetTotalAllocated() != want {
+		t.Fatalf("%d bytes are allocated after recovery, want %d", got.GetTotalAllocated(), want)
+	}
+	for _, r := range []*Result{committed, allocated} {
+		if n := got.countAllocated(r.Offset/blockSize, r.Size/blockSize); n != r.Size/blockSize {
+			t.Fatalf("[%d, %d) was not recovered as allocated", r.Offset, r.Offset+r.Size)
+		}
+	}
+	for _, r := range []*Result{reserved, returned, unreserved} {
+		if n := got.countAllocated(r.Offset/blockSize, r.Size/blockSize); n != 0 {
+			t.Fatalf("reservation [%d, %d) was recovered as allocated", r.Offset, r.Offset+r.Size)
+		}
+	}
+
+	// Without a journal, committing is a no-op
+	b.SetJournal(nil)
+	if err := b.Commit(reserved.Offset, reserved.Size); err != nil {
+		t.Fatal(err)
+	}
+	if journal.Len() != 4*journalRecordSize {
+		t.Fatalf("journal holds %d bytes, want 4 records", journal.Len())
+	}
+}
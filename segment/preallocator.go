@@ -1,6 +1,7 @@
 package segment
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -10,33 +11,96 @@ import (
 type PreallocConfig struct {
 	InitialSize   uint64        // Initial size to pre-allocate
 	GrowthFactor  float64       // Factor to grow pre-allocated space
-	MaxSize       uint64        // Maximum size to pre-allocate
+	MaxSize       uint64        // High watermark, pooled and stream window space past it is released
 	CheckInterval time.Duration // Interval to check and grow pre-allocated space
-	MinFreeSpace  uint64        // Minimum free space to maintain
+	MinFreeSpace  uint64        // Low watermark, pooled space is grown when below it
+	PageSize      uint32        // Unit that requests are rounded up to, 4 KiB if zero
+	StreamWindow  uint64        // Space reserved per stream at a time, 0 disables stream windows
+	SizeClasses   []SizeClass   // Common allocation sizes to keep ready extents for
 }
 
-// Preallocator manages pre-allocated space
+// SizeClass is a common allocation size, such as 4 KiB delta pages or 64 KiB
+// index pages, for which the pre-allocator keeps extents ready. Allocations
+// of exactly that size, once rounded up to whole pages, are served from the
+// class without touching the allocator.
+type SizeClass struct {
+	Size          uint64 // Allocation size
+	LowWatermark  int    // Refill when fewer extents are ready
+	HighWatermark int    // Number of ready extents to refill up to
+}
+
+// classPool holds the ready extents of one size class
+type classPool struct {
+	class SizeClass
+	ready []uint64 // Offsets of ready extents
+	mu    sync.Mutex
+}
+
+// Preallocator manages pre-allocated space. Pooled extents, stream windows
+// and size class extents are allocated in the allocator and owned by the
+// pre-allocator until it hands them out; after that they belong to the
+// caller, who frees them to the allocator like any other allocation.
+//
+// The pool sits behind one lock, so it is skipped for grouped allocators:
+// their groups are locked independently, and a shared pool in front of them
+// would serialize the writers again. Size classes and stream windows have
+// locks of their own and are used with every allocator.
 type Preallocator struct {
-	config     PreallocConfig
-	allocator  *BitmapAllocator
-	prealloced []struct {
-		offset uint64
-		size   uint64
-	}
-	mutex    sync.RWMutex
-	stopChan chan struct{}
+	config    PreallocConfig
+	allocator Allocator
+	pool      extentTree               // Pre-allocated extents by offset, adjacent ones coalesced
+	pooled    uint64                   // Total size of the pool
+	pooling   bool                     // Whether GetSpace uses the pool, false for grouped allocators
+	streams   map[uint64]*streamWindow // Reserved windows by stream
+	classes   map[uint64]*classPool    // Size class pools by rounded size, fixed after creation
+	mutex     sync.RWMutex
+	refill    chan struct{} // Wakes manage when the pool or a class runs low
+	stopChan  chan struct{}
+	done      chan struct{} // Closed when manage returns
+	bgErr     error         // First failure to free space in the background
+	errMu     sync.Mutex    // Guards bgErr
+}
+
+// streamWindow is the space reserved for one stream. Requests are carved
+// from offset up to end; end is also the placement hint for the next window
+// once this one is exhausted or released. Carving under a shared p.mutex
+// takes mu; with p.mutex held exclusively it is not needed.
+type streamWindow struct {
+	offset uint64 // Next unused byte of the window
+	end    uint64 // End of the window
+	mu     sync.Mutex
 }
 
 // NewPreallocator creates a new pre-allocator
-func NewPreallocator(allocator *BitmapAllocator, config PreallocConfig) *Preallocator {
+func NewPreallocator(allocator Allocator, config PreallocConfig) *Preallocator {
+	if config.PageSize == 0 {
+		config.PageSize = defaultPageSize
+	}
 	prealloc := &Preallocator{
 		config:    config,
 		allocator: allocator,
+		pool:      extentTree{less: byOffset},
+		streams:   make(map[uint64]*streamWindow),
+		classes:   make(map[uint64]*classPool),
+		refill:    make(chan struct{}, 1),
 		stopChan:  make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	_, grouped := allocator.(GroupedAllocator)
+	prealloc.pooling = !grouped
+	for _, class := range config.SizeClasses {
+		class.Size = bitmapRoundup(class.Size, uint64(config.PageSize))
+		if class.Size > 0 {
+			prealloc.classes[class.Size] = &classPool{class: class}
+		}
 	}
 
-	// Initial pre-allocation
+	// Initial pre-allocation, topped up to the low watermark
+	prealloc.mutex.Lock()
 	prealloc.preallocate(config.InitialSize)
+	prealloc.mutex.Unlock()
+	prealloc.recordErr(prealloc.checkAndGrow())
+	prealloc.refillClasses()
 
 	// Start background goroutine for space management
 	go prealloc.manage()
@@ -44,128 +108,556 @@ func NewPreallocator(allocator *BitmapAllocator, config PreallocConfig) *Preallo
 	return prealloc
 }
 
-// preallocate pre-allocates space of the specified size
+// preallocate pre-allocates about size bytes into the pool, in smaller
+// extents when the allocator has no contiguous space for all of it. Nothing
+// is pooled when the pool is skipped. The caller must hold p.mutex.
 func (p *Preallocator) preallocate(size uint64) {
-	// Allocate space
-	result := p.allocator.Allocate(uint32(size))
-	if !result.Success {
-		fmt.Sprintf("fiale")
+	if !p.pooling {
 		return
 	}
-	fmt.Sprintf("success")
-	// Add to pre-allocated blocks
-	p.prealloced = append(p.prealloced, struct {
-		offset uint64
-		size   uint64
-	}{
-		offset: result.Offset,
-		size:   result.Size,
-	})
+	chunk := size
+	for size > 0 && chunk >= uint64(p.config.PageSize) {
+		result, err := p.reserve(min(chunk, size), 0)
+		if err != nil {
+			var spaceErr *SpaceError
+			if !errors.As(err, &spaceErr) || spaceErr.Err != ErrNoContiguousSpace {
+				return
+			}
+			// Go straight for the largest free extent; the chunk always
+			// shrinks so that concurrent allocations cannot stall the loop
+			chunk = bitmapAlign(min(spaceErr.LargestFree, min(chunk, size)-1), uint64(p.config.PageSize))
+			continue
+		}
+		p.addToPool(extent{offset: result.Offset, length: result.Size})
+		size -= min(result.Size, size)
+	}
 }
 
-// GetSpace returns a pre-allocated space block
+// reserve allocates space for the pre-allocator to hold, near hint if the
+// allocator supports that. Allocators with a journal leave reserved
+// space out of it, so that it does not survive a crash.
+func (p *Preallocator) reserve(size, hint uint64) (*Result, error) {
+	switch a := p.allocator.(type) {
+	case ReservingAllocator:
+		return a.Reserve(size, hint)
+	case HintAllocator:
+		return a.AllocateNear(size, hint)
+	default:
+		return p.allocator.Allocate(size)
+	}
+}
+
+// unreserve frees reserved space that was never handed out
+func (p *Preallocator) unreserve(offset, size uint64) error {
+	if a, ok := p.allocator.(ReservingAllocator); ok {
+		return a.Unreserve(offset, size)
+	}
+	return p.allocator.Free(offset, size)
+}
+
+// commit makes reserved space a journaled allocation as it is handed out
+func (p *Preallocator) commit(offset, size uint64) error {
+	if a, ok := p.allocator.(ReservingAllocator); ok {
+		return a.Commit(offset, size)
+	}
+	return nil
+}
+
+// addToPool inserts an extent into the pool, coalescing it with adjacent
+// pooled extents; the caller must hold p.mutex
+func (p *Preallocator) addToPool(e extent) {
+	p.pooled += e.length
+	if n := p.pool.floor(e.offset); n != nil && n.end() == e.offset {
+		prev := n.extent
+		p.pool.remove(prev)
+		e.offset = prev.offset
+		e.length += prev.length
+	}
+	if n := p.pool.ceil(e.end()); n != nil && n.offset == e.end() {
+		next := n.extent
+		p.pool.remove(next)
+		e.length += next.length
+	}
+	p.pool.insert(e)
+}
+
+// takeFromPool removes length bytes from the front of a pooled extent; the
+// caller must hold p.mutex
+func (p *Preallocator) takeFromPool(e extent, length uint64) {
+	p.pool.remove(e)
+	if e.length > length {
+		p.pool.insert(extent{offset: e.offset + length, length: e.length - length})
+	}
+	p.pooled -= length
+}
+
+// GetSpace returns exactly size bytes, rounded up to whole pages. Sizes with
+// a size class are served from the class; other sizes are carved from the
+// first pooled extent that is large enough, keeping the rest of it pooled.
+// A miss or a pool that drops below MinFreeSpace wakes manage to refill it.
+// Space that cannot be committed to the allocator's journal is kept and
+// reported as a miss. Without a pool, every other size is a miss.
 func (p *Preallocator) GetSpace(size uint64) (uint64, uint64, bool) {
+	if size == 0 {
+		return 0, 0, false
+	}
+	length := bitmapRoundup(size, uint64(p.config.PageSize))
+	if length < size {
+		return 0, 0, false
+	}
+	if c, ok := p.classes[length]; ok {
+		if offset, ok := p.takeFromClass(c); ok {
+			return offset, length, true
+		}
+	}
+	if !p.pooling {
+		return 0, 0, false
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n := p.pool.firstFit(length)
+	if n == nil {
+		p.requestRefill()
+		return 0, 0, false
+	}
+	e := n.extent
+	if err := p.commit(e.offset, length); err != nil {
+		return 0, 0, false
+	}
+	p.takeFromPool(e, length)
+	if p.pooled < p.config.MinFreeSpace {
+		p.requestRefill()
+	}
+	return e.offset, length, true
+}
+
+// GetStreamSpace carves space for a stream, such as an open block file, from
+// the stream's reserved window, so that its appends stay contiguous however
+// many other streams are writing. When the window runs out, its remainder is
+// freed and a new window is allocated right where the remainder started if
+// possible. It fails if stream windows are disabled or the allocator cannot
+// provide a new window. Requests that fit the window only hold p.mutex
+// shared, so streams do not wait for each other.
+func (p *Preallocator) GetStreamSpace(stream, size uint64) (uint64, uint64, error) {
+	if p.config.StreamWindow == 0 {
+		return 0, 0, fmt.Errorf("stream windows are disabled")
+	}
+	if size == 0 {
+		return 0, 0, ErrZeroSize
+	}
+	length := bitmapRoundup(size, uint64(p.config.PageSize))
+	if length < size {
+		return 0, 0, fmt.Errorf("%w: requested %d bytes", ErrNoSpace, size)
+	}
+
+	p.mutex.RLock()
+	if w, ok := p.streams[stream]; ok {
+		offset, ok, err := p.carveWindow(w, length)
+		if ok || err != nil {
+			p.mutex.RUnlock()
+			return offset, length, err
+		}
+	}
+	p.mutex.RUnlock()
+
+	// Creating or refilling a window reserves space, which needs p.mutex
+	// exclusively
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	p.preallocate(size)
-	// Find a suitable pre-allocated block
-	for i, block := range p.prealloced {
-		if block.size >= size {
-			// Remove the block from pre-allocated list
-			p.prealloced = append(p.prealloced[:i], p.prealloced[i+1:]...)
-			return block.offset, block.size, true
+
+	w, ok := p.streams[stream]
+	if !ok {
+		w = &streamWindow{}
+		p.streams[stream] = w
+	}
+	if w.end-w.offset < length {
+		if err := p.refillWindow(stream, w, max(length, p.config.StreamWindow)); err != nil {
+			return 0, 0, err
 		}
 	}
+	offset, _, err := p.carveWindow(w, length)
+	return offset, length, err
+}
 
-	return 0, 0, false
+// carveWindow takes length bytes from the front of a stream's window and
+// commits them, reporting false if the window is too small; the caller must
+// hold p.mutex
+func (p *Preallocator) carveWindow(w *streamWindow, length uint64) (uint64, bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.end-w.offset < length {
+		return 0, false, nil
+	}
+	offset := w.offset
+	if err := p.commit(offset, length); err != nil {
+		return 0, false, err
+	}
+	w.offset += length
+	return offset, true, nil
+}
+
+// refillWindow replaces the remainder of a stream's window with a new window
+// of the specified size; the caller must hold p.mutex
+func (p *Preallocator) refillWindow(stream uint64, w *streamWindow, size uint64) error {
+	if err := p.releaseWindow(w); err != nil {
+		return err
+	}
+
+	var result *Result
+	var err error
+	if a, ok := p.allocator.(StreamAllocator); ok {
+		result, err = a.AllocateStream(stream, size)
+	} else {
+		result, err = p.reserve(size, w.end)
+	}
+	if err != nil {
+		return err
+	}
+	w.offset = result.Offset
+	w.end = result.Offset + result.Size
+	return nil
+}
+
+// releaseWindow frees the unused rest of a stream's window. The window
+// shrinks to its next unused byte, which stays the placement hint for the
+// stream's next window so that its appends continue where they left off.
+// Space the allocator refuses to free is dropped. The caller must hold
+// p.mutex.
+func (p *Preallocator) releaseWindow(w *streamWindow) error {
+	if w.offset == w.end {
+		return nil
+	}
+	err := p.unreserve(w.offset, w.end-w.offset)
+	if err != nil {
+		err = fmt.Errorf("failed to release stream window [%d, %d): %w", w.offset, w.end, err)
+	}
+	w.end = w.offset
+	return err
 }
 
-// ReturnSpace returns a space block to the pre-allocator
-func (p *Preallocator) ReturnSpace(offset, size uint64) {
+// CloseStream frees the unused part of a stream's window and forgets the
+// stream
+func (p *Preallocator) CloseStream(stream uint64) error {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	p.prealloced = append(p.prealloced, struct {
-		offset uint64
-		size   uint64
-	}{
-		offset: offset,
-		size:   size,
-	})
+	w, ok := p.streams[stream]
+	if !ok {
+		return nil
+	}
+	delete(p.streams, stream)
+	if w.offset < w.end {
+		return p.unreserve(w.offset, w.end-w.offset)
+	}
+	return nil
+}
+
+// takeFromClass pops a ready extent of a size class and wakes manage when
+// the class drops below its low watermark
+func (p *Preallocator) takeFromClass(c *classPool) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.ready) == 0 {
+		p.requestRefill()
+		return 0, false
+	}
+	offset := c.ready[len(c.ready)-1]
+	if err := p.commit(offset, c.class.Size); err != nil {
+		return 0, false
+	}
+	c.ready = c.ready[:len(c.ready)-1]
+	if len(c.ready) < c.class.LowWatermark {
+		p.requestRefill()
+	}
+	return offset, true
+}
+
+// Free frees space that was handed out to the allocator. A range that
+// overlaps pooled space, a stream window or a ready size class extent is
+// rejected with ErrDoubleFree: that space is allocated in the allocator on
+// the pre-allocator's behalf, so freeing it would let it be handed out
+// twice. Nothing can be reserved between the check and the free.
+func (p *Preallocator) Free(offset, size uint64) error {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if length := bitmapRoundup(size, uint64(p.config.PageSize)); length >= size && p.owns(offset, length) {
+		return fmt.Errorf("%w: [%d, %d) is pre-allocated", ErrDoubleFree, offset, offset+length)
+	}
+	return p.allocator.Free(offset, size)
+}
+
+// owns reports whether any of the range is pooled, in a stream window or a
+// ready size class extent; the caller must hold p.mutex
+func (p *Preallocator) owns(offset, length uint64) bool {
+	if length == 0 {
+		return false
+	}
+	end := offset + length
+	if n := p.pool.floor(offset); n != nil && n.end() > offset {
+		return true
+	}
+	if n := p.pool.ceil(offset); n != nil && n.offset < end {
+		return true
+	}
+	for _, w := range p.streams {
+		w.mu.Lock()
+		overlaps := w.offset < w.end && w.offset < end && offset < w.end
+		w.mu.Unlock()
+		if overlaps {
+			return true
+		}
+	}
+	for _, c := range p.classes {
+		c.mu.Lock()
+		for _, ready := range c.ready {
+			if ready < end && offset < ready+c.class.Size {
+				c.mu.Unlock()
+				return true
+			}
+		}
+		c.mu.Unlock()
+	}
+	return false
+}
+
+// requestRefill wakes manage without blocking
+func (p *Preallocator) requestRefill() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// refillClasses tops up every size class that is below its low watermark.
+// It holds p.mutex so that it cannot run inside WithReleased.
+func (p *Preallocator) refillClasses() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, c := range p.classes {
+		c.mu.Lock()
+		if len(c.ready) < c.class.LowWatermark {
+			for len(c.ready) < c.class.HighWatermark {
+				result, err := p.reserve(c.class.Size, 0)
+				if err != nil {
+					break
+				}
+				// Allocators that round up, such as the buddy allocator,
+				// get the excess back so a class extent is exactly its size
+				if result.Size > c.class.Size {
+					p.recordErr(p.unreserve(result.Offset+c.class.Size, result.Size-c.class.Size))
+				}
+				c.ready = append(c.ready, result.Offset)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// ReturnSpace hands a block back to the pre-allocator instead of freeing
+// it, where it is coalesced with adjacent pooled space. The block must still
+// be allocated in the allocator: pooled space is allocated space that the
+// pre-allocator owns, so a block must never be both pooled and freed. The
+// block is journaled as freed, like any other reservation. Without a pool
+// the block is freed instead.
+func (p *Preallocator) ReturnSpace(offset, size uint64) error {
+	if !p.pooling {
+		return p.Free(offset, size)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if size == 0 {
+		return nil
+	}
+	length := bitmapRoundup(size, uint64(p.config.PageSize))
+	if length < size {
+		return fmt.Errorf("%w: %d bytes at %d", ErrOutOfRange, size, offset)
+	}
+	if a, ok := p.allocator.(ReservingAllocator); ok {
+		if err := a.Uncommit(offset, length); err != nil {
+			return err
+		}
+	}
+	p.addToPool(extent{offset: offset, length: length})
+	return nil
 }
 
 // manage handles background tasks for the pre-allocator
 func (p *Preallocator) manage() {
+	defer close(p.done)
 	ticker := time.NewTicker(p.config.CheckInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			p.checkAndGrow()
+			p.recordErr(p.checkAndGrow())
+			p.refillClasses()
+		case <-p.refill:
+			p.recordErr(p.checkAndGrow())
+			p.refillClasses()
 		case <-p.stopChan:
 			return
 		}
 	}
 }
 
-// checkAndGrow checks available space and grows pre-allocated space if needed
-func (p *Preallocator) checkAndGrow() {
+// checkAndGrow keeps the pool between its watermarks. Below MinFreeSpace
+// the pool grows by GrowthFactor, to at least MinFreeSpace and at most
+// MaxSize; above MaxSize the excess is released to the allocator, and so is
+// the rest of stream windows while they take the total past MaxSize.
+func (p *Preallocator) checkAndGrow() error {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	// Calculate total pre-allocated space
-	var totalPrealloced uint64
-	for _, block := range p.prealloced {
-		totalPrealloced += block.size
+	if p.pooled < p.config.MinFreeSpace {
+		target := max(p.config.MinFreeSpace, uint64(float64(p.pooled)*p.config.GrowthFactor))
+		target = min(target, p.config.MaxSize)
+		if target > p.pooled {
+			p.preallocate(target - p.pooled)
+		}
 	}
 
-	// Calculate current utilization
-	utilization := p.allocator.GetUtilization()
-
-	// Determine if we need to grow
-	if utilization > 0.8 && totalPrealloced < p.config.MaxSize {
-		// Calculate new size based on growth factor
-		newSize := uint64(float64(totalPrealloced) * p.config.GrowthFactor)
-		if newSize > p.config.MaxSize {
-			newSize = p.config.MaxSize
+	if p.pooled > p.config.MaxSize {
+		// Free excess space from the end of the highest extents
+		if err := p.shrinkPool(p.pooled - p.config.MaxSize); err != nil {
+			return err
 		}
+	}
+	return p.trimWindows()
+}
 
-		// Pre-allocate additional space
-		additionalSize := newSize - totalPrealloced
-		if additionalSize > 0 {
-			p.preallocate(additionalSize)
+// trimWindows releases the rest of stream windows while they and the pool
+// together hold more than MaxSize, so that open streams cannot keep space
+// reserved indefinitely. A trimmed stream gets a new window at its next
+// append, right where it left off if that space is still free. The caller
+// must hold p.mutex.
+func (p *Preallocator) trimWindows() error {
+	held := p.pooled
+	for _, w := range p.streams {
+		held += w.end - w.offset
+	}
+	for _, w := range p.streams {
+		if held <= p.config.MaxSize {
+			break
+		}
+		held -= w.end - w.offset
+		if err := p.releaseWindow(w); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	// Check if we have too much pre-allocated space
-	if totalPrealloced > p.config.MaxSize {
-		// Free excess space
-		excess := totalPrealloced - p.config.MaxSize
-		for i := len(p.prealloced) - 1; i >= 0; i-- {
-			if excess <= 0 {
-				break
-			}
-			block := p.prealloced[i]
-			if block.size <= excess {
-				p.allocator.Free(uint32(block.offset), uint32(block.size))
-				excess -= block.size
-				p.prealloced = append(p.prealloced[:i], p.prealloced[i+1:]...)
-			}
+// recordErr keeps the first error of a background task for Release to
+// report
+func (p *Preallocator) recordErr(err error) {
+	if err == nil {
+		return
+	}
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	if p.bgErr == nil {
+		p.bgErr = err
+	}
+}
+
+// shrinkPool frees about excess bytes of pooled space, trimming the highest
+// extents first. It stops at the first extent the allocator refuses to
+// free, which stays pooled. The caller must hold p.mutex.
+func (p *Preallocator) shrinkPool(excess uint64) error {
+	var extents []extent
+	p.pool.ascend(func(e extent) bool {
+		extents = append(extents, e)
+		return true
+	})
+	for i := len(extents) - 1; i >= 0 && excess > 0; i-- {
+		e := extents[i]
+		trim := bitmapAlign(min(excess, e.length), uint64(p.config.PageSize))
+		if trim == 0 {
+			break
+		}
+		if err := p.unreserve(e.end()-trim, trim); err != nil {
+			return fmt.Errorf("failed to release pooled space: %w", err)
 		}
+		p.pool.remove(e)
+		if e.length > trim {
+			p.pool.insert(extent{offset: e.offset, length: e.length - trim})
+		}
+		p.pooled -= trim
+		excess -= trim
 	}
+	return nil
 }
 
-// Close stops the pre-allocator and frees all pre-allocated space
-func (p *Preallocator) Close() {
-	close(p.stopChan)
+// Release frees all pre-allocated space back to the allocator. Space the
+// allocator refuses to free is dropped; the failures are returned together
+// with any earlier failure of the background tasks.
+func (p *Preallocator) Release() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.release()
+}
 
+// WithReleased frees all pre-allocated space like Release and then runs fn
+// before anything can be pre-allocated again, so that fn sees the allocator
+// without any reservations. fn must not call back into the pre-allocator.
+func (p *Preallocator) WithReleased(fn func() error) error {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	// Free all pre-allocated space
-	for _, block := range p.prealloced {
-		p.allocator.Free(uint32(block.offset), uint32(block.size))
+	if err := p.release(); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// release implements Release; the caller must hold p.mutex
+func (p *Preallocator) release() error {
+	p.errMu.Lock()
+	errs := []error{p.bgErr}
+	p.bgErr = nil
+	p.errMu.Unlock()
+	release := func(offset, length uint64) {
+		if err := p.unreserve(offset, length); err != nil {
+			errs = append(errs, fmt.Errorf("failed to release [%d, %d): %w", offset, offset+length, err))
+		}
+	}
+
+	p.pool.ascend(func(e extent) bool {
+		release(e.offset, e.length)
+		return true
+	})
+	p.pool.reset()
+	p.pooled = 0
+
+	for _, w := range p.streams {
+		if err := p.releaseWindow(w); err != nil {
+			errs = append(errs, err)
+		}
 	}
-	p.prealloced = nil
+
+	for _, c := range p.classes {
+		c.mu.Lock()
+		for _, offset := range c.ready {
+			release(offset, c.class.Size)
+		}
+		c.ready = nil
+		c.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// Close stops the pre-allocator and frees all pre-allocated space once the
+// background goroutine has returned
+func (p *Preallocator) Close() error {
+	close(p.stopChan)
+	<-p.done
+	return p.Release()
 }
@@ -0,0 +1,178 @@
+package segment
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestPreallocator returns a pre-allocator on a bitmap allocator over
+// size bytes whose background refill only runs when it is asked to
+func newTestPreallocator(t *testing.T, size uint64, config PreallocConfig) (*Preallocator, *BitmapAllocator) {
+	t.Helper()
+	allocator := NewBitmapAllocator()
+	allocator.Init(size, blockSize)
+	config.CheckInterval = time.Hour
+	p := NewPreallocator(allocator, config)
+	t.Cleanup(func() {
+		if err := p.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return p, allocator
+}
+
+// TestPreallocatorStreamWindowsBounded opens more stream windows than
+// MaxSize allows and checks that they are trimmed
+func TestPreallocatorStreamWindowsBounded(t *testing.T) {
+	const window = 1 << 20
+	p, _ := newTestPreallocator(t, 64<<20, PreallocConfig{
+		MaxSize:      4 * window,
+		MinFreeSpace: window,
+		GrowthFactor: 1,
+		StreamWindow: window,
+	})
+
+	for stream := uint64(0); stream < 6; stream++ {
+		if _, _, err := p.GetStreamSpace(stream, blockSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.checkAndGrow(); err != nil {
+		t.Fatal(err)
+	}
+
+	p.mutex.Lock()
+	held := p.pooled
+	for _, w := range p.streams {
+		held += w.end - w.offset
+	}
+	p.mutex.Unlock()
+	if held > p.config.MaxSize {
+		t.Fatalf("pool and stream windows hold %d bytes, more than MaxSize %d", held, p.config.MaxSize)
+	}
+}
+
+// TestPreallocatorStreamTrimmed checks that a stream whose window was
+// trimmed continues right after its last append
+func TestPreallocatorStreamTrimmed(t *testing.T) {
+	const window = 1 << 20
+	p, _ := newTestPreallocator(t, 64<<20, PreallocConfig{
+		MaxSize:      window,
+		MinFreeSpace: window / 2,
+		GrowthFactor: 1,
+		StreamWindow: window,
+	})
+
+	offset, length, err := p.GetStreamSpace(1, blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.checkAndGrow(); err != nil {
+		t.Fatal(err)
+	}
+	p.mutex.Lock()
+	trimmed := p.streams[1].offset == p.streams[1].end
+	p.mutex.Unlock()
+	if !trimmed {
+		t.Fatal("the stream window was not trimmed")
+	}
+
+	next, _, err := p.GetStreamSpace(1, blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != offset+length {
+		t.Fatalf("stream continued at %d, want %d", next, offset+length)
+	}
+}
+
+// TestPreallocatorWatermarks checks that the pool is topped up to
+// MinFreeSpace, grows by GrowthFactor below it and is trimmed to MaxSize
+func TestPreallocatorWatermarks(t *testing.T) {
+	p, allocator := newTestPreallocator(t, 64<<20, PreallocConfig{
+		MinFreeSpace: 1 << 20,
+		MaxSize:      4 << 20,
+		GrowthFactor: 3,
+	})
+	pooled := func() uint64 {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		return p.pooled
+	}
+	if got := pooled(); got != 1<<20 {
+		t.Fatalf("%d bytes are pooled after creation, want MinFreeSpace", got)
+	}
+
+	// Below the low watermark the pool grows by GrowthFactor
+	offset, length, ok := p.GetSpace(256 << 10)
+	if !ok {
+		t.Fatal("the pool missed")
+	}
+	if err := p.checkAndGrow(); err != nil {
+		t.Fatal(err)
+	}
+	if got := pooled(); got != 3*(768<<10) {
+		t.Fatalf("%d bytes are pooled after growing, want 3 times the 768 KiB left", got)
+	}
+
+	// Above the high watermark the excess goes back to the allocator
+	res, err := allocator.Allocate(3 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ReturnSpace(res.Offset, res.Size); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.checkAndGrow(); err != nil {
+		t.Fatal(err)
+	}
+	if got := pooled(); got != 4<<20 {
+		t.Fatalf("%d bytes are pooled after trimming, want MaxSize", got)
+	}
+	if got, want := allocator.GetTotalAllocated(), uint64(4<<20)+length; got != want {
+		t.Fatalf("%d bytes are allocated, want %d pooled and handed out", got, want)
+	}
+	if err := allocator.Free(offset, length); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPreallocatorRefillOnMiss empties the pool and a size class and checks
+// that the background task refills them right away rather than at the next
+// CheckInterval tick, which is an hour away
+func TestPreallocatorRefillOnMiss(t *testing.T) {
+	const classSize = 64 << 10
+	p, _ := newTestPreallocator(t, 64<<20, PreallocConfig{
+		MinFreeSpace: 1 << 20,
+		MaxSize:      4 << 20,
+		GrowthFactor: 2,
+		SizeClasses:  []SizeClass{{Size: classSize, LowWatermark: 2, HighWatermark: 4}},
+	})
+
+	if _, _, ok := p.GetSpace(p.config.MinFreeSpace); !ok {
+		t.Fatal("the pool missed")
+	}
+	for i := 0; i < 4; i++ {
+		if _, _, ok := p.GetSpace(classSize); !ok {
+			t.Fatal("the size class missed")
+		}
+	}
+
+	class := p.classes[classSize]
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		p.mutex.Lock()
+		pooled := p.pooled
+		p.mutex.Unlock()
+		class.mu.Lock()
+		ready := len(class.ready)
+		class.mu.Unlock()
+		if pooled >= p.config.MinFreeSpace && ready >= class.class.LowWatermark {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d bytes are pooled and %d class extents ready long after draining them", pooled, ready)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -2,7 +2,18 @@ package segment
 
 // Result represents the result of an allocation request
 type Result struct {
-	Success bool   // Whether the allocation was successful
-	Offset  uint64 // Starting offset of the allocated space
-	Size    uint64 // Size of the allocated space
+	Offset uint64 // Starting offset of the allocated space
+	Size   uint64 // Size of the allocated space
+}
+
+// Extent is a contiguous range of allocated space
+type Extent struct {
+	Offset uint64 // Starting offset of the extent
+	Size   uint64 // Size of the extent
+}
+
+// VectorResult represents the result of a vectored allocation request
+type VectorResult struct {
+	Extents []Extent // Allocated extents in offset order
+	Size    uint64   // Total size of the allocated extents
 }
@@ -2,23 +2,143 @@ package segment
 
 import (
 	"fmt"
+	"io"
 	"sync"
 	"time"
 )
 
+const (
+	// Segment defaults
+	defaultPageSize         = 4096 // Minimum allocation unit
+	defaultLogicalBlockSize = 512  // Logical block size of the device
+)
+
 // Segment represents a memory segment with allocation capabilities
 type Segment struct {
-	allocator    *BitmapAllocator // Main space allocator
-	preallocator *Preallocator    // Pre-allocation manager
-	mu           sync.RWMutex     // Read-write mutex for thread safety
+	allocator    Allocator     // Main space allocator
+	preallocator *Preallocator // Pre-allocation manager
+	pageSize     uint32        // Minimum allocation unit
+	mu           sync.RWMutex  // Shared by Allocate and Free, exclusive for Close, Save and Resize
+}
+
+// SegmentConfig represents the configuration of a segment
+type SegmentConfig struct {
+	Size             uint64      // Size of the managed space
+	PageSize         uint32      // Minimum allocation unit, 4 KiB if zero
+	LogicalBlockSize uint32      // Logical block size of the device, 512 bytes if zero
+	Allocator        Allocator   // Uninitialized allocator, a BitmapAllocator if nil
+	SizeClasses      []SizeClass // Allocation sizes to keep ready extents for, none if empty
 }
 
 // NewSegment creates a new segment with the specified size
 func NewSegment(size uint64) (*Segment, error) {
-	// Create bitmap allocator
+	return NewSegmentWithConfig(SegmentConfig{Size: size})
+}
+
+// NewSegmentWithAllocator creates a new segment of the specified size on
+// top of an uninitialized allocator
+func NewSegmentWithAllocator(size uint64, allocator Allocator) (*Segment, error) {
+	if allocator == nil {
+		return nil, fmt.Errorf("allocator must not be nil")
+	}
+	return NewSegmentWithConfig(SegmentConfig{Size: size, Allocator: allocator})
+}
+
+// NewSegmentWithConfig creates a new segment from a configuration. The page
+// size must be a power of two and a multiple of the logical block size.
+func NewSegmentWithConfig(config SegmentConfig) (*Segment, error) {
+	if config.PageSize == 0 {
+		config.PageSize = defaultPageSize
+	}
+	if config.LogicalBlockSize == 0 {
+		config.LogicalBlockSize = defaultLogicalBlockSize
+	}
+	if config.Allocator == nil {
+		config.Allocator = NewBitmapAllocator()
+	}
+	if !isPowerOfTwo(uint64(config.LogicalBlockSize)) {
+		return nil, fmt.Errorf("logical block size %d is not a power of two", config.LogicalBlockSize)
+	}
+	if !isPowerOfTwo(uint64(config.PageSize)) || config.PageSize%config.LogicalBlockSize != 0 {
+		return nil, fmt.Errorf("page size %d is not a power-of-two multiple of the logical block size %d",
+			config.PageSize, config.LogicalBlockSize)
+	}
+
+	config.Allocator.Init(config.Size, config.PageSize)
+	return newSegment(config.Allocator, config.PageSize, config.SizeClasses), nil
+}
+
+// LoadSegment reopens a segment from an allocator image written by Save,
+// optionally followed by records written by Checkpoint
+func LoadSegment(r io.Reader) (*Segment, error) {
+	return LoadSegmentWithConfig(r, SegmentConfig{})
+}
+
+// LoadSegmentWithConfig reopens a segment like LoadSegment with the size
+// classes of a configuration. The size, page size and allocator come from
+// the image; non-zero values in the configuration must match them.
+func LoadSegmentWithConfig(r io.Reader, config SegmentConfig) (*Segment, error) {
+	allocator, err := loadAllocator(r, config)
+	if err != nil {
+		return nil, err
+	}
+	return newSegment(allocator, allocator.pageSize, config.SizeClasses), nil
+}
+
+// RecoverSegment reopens a segment like LoadSegment and then replays the
+// journal written since the last checkpoint. The replay happens before any
+// space is pre-allocated so that journaled allocations cannot be handed out.
+func RecoverSegment(image io.Reader, journal io.Reader) (*Segment, *ReplayResult, error) {
+	return RecoverSegmentWithConfig(image, journal, SegmentConfig{})
+}
+
+// RecoverSegmentWithConfig recovers a segment like RecoverSegment with the
+// size classes of a configuration, which is checked like in
+// LoadSegmentWithConfig
+func RecoverSegmentWithConfig(image io.Reader, journal io.Reader, config SegmentConfig) (*Segment, *ReplayResult, error) {
+	allocator, err := loadAllocator(image, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	result, err := allocator.Replay(journal)
+	if err != nil {
+		return nil, result, fmt.Errorf("failed to replay journal: %w", err)
+	}
+	return newSegment(allocator, allocator.pageSize, config.SizeClasses), result, nil
+}
+
+// loadAllocator reads a full image and any following checkpoint records
+// and checks them against a configuration
+func loadAllocator(r io.Reader, config SegmentConfig) (*BitmapAllocator, error) {
+	if config.Allocator != nil {
+		return nil, fmt.Errorf("failed to load segment: the allocator is loaded from the image")
+	}
 	allocator := NewBitmapAllocator()
-	allocator.Init(size, 4096)
+	if err := allocator.Load(r); err != nil {
+		return nil, fmt.Errorf("failed to load segment: %w", err)
+	}
+	for {
+		err := allocator.ApplyCheckpoint(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load segment: %w", err)
+		}
+	}
+	if config.Size != 0 && config.Size != allocator.totalSize {
+		return nil, fmt.Errorf("failed to load segment: image size %d does not match %d",
+			allocator.totalSize, config.Size)
+	}
+	if config.PageSize != 0 && config.PageSize != allocator.pageSize {
+		return nil, fmt.Errorf("failed to load segment: image page size %d does not match %d",
+			allocator.pageSize, config.PageSize)
+	}
+	return allocator, nil
+}
 
+// newSegment wraps an initialized allocator into a segment
+func newSegment(allocator Allocator, pageSize uint32, sizeClasses []SizeClass) *Segment {
 	// Create preallocator with default configuration
 	preallocator := NewPreallocator(allocator, PreallocConfig{
 		InitialSize:   1024 * 1024, // 1MB
@@ -26,83 +146,332 @@ func NewSegment(size uint64) (*Segment, error) {
 		MaxSize:       100 * 1024 * 1024, // 100MB
 		CheckInterval: 5 * time.Minute,
 		MinFreeSpace:  10 * 1024 * 1024, // 10MB
+		PageSize:      pageSize,
+		StreamWindow:  8 * 1024 * 1024, // 8MB
+		SizeClasses:   sizeClasses,
 	})
 
 	return &Segment{
 		allocator:    allocator,
 		preallocator: preallocator,
-	}, nil
+		pageSize:     pageSize,
+	}
 }
 
-// Allocate allocates space of the specified size
+// Allocate allocates space of the specified size. It fails with
+// ErrZeroSize, ErrClosed or a *SpaceError that tells a full segment from a
+// fragmented one.
 func (s *Segment) Allocate(size uint64) (*Result, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.allocator == nil {
+		return nil, ErrClosed
+	}
+	if size == 0 {
+		return nil, ErrZeroSize
+	}
+
 	// Try to get pre-allocated space first
-	offset, size, found := s.preallocator.GetSpace(size)
+	offset, length, found := s.preallocator.GetSpace(size)
 	if found {
 		return &Result{
-			Success: true,
-			Offset:  offset,
-			Size:    size,
+			Offset: offset,
+			Size:   length,
 		}, nil
 	}
 
 	// If no pre-allocated space available, allocate new space
-	result := s.allocator.Allocate(uint32(size))
-	if !result.Success {
-		return nil, fmt.Errorf("failed to allocate space")
+	return s.allocator.Allocate(size)
+}
+
+// AllocateAligned allocates space of the specified size at an offset that is
+// a multiple of align, e.g. 64 KiB for index files. align must be a power of
+// two and a multiple of the segment's page size. The pre-allocation pool is
+// bypassed since its blocks are only page aligned.
+func (s *Segment) AllocateAligned(size, align uint64) (*Result, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.allocator == nil {
+		return nil, ErrClosed
 	}
-	return result, nil
+	if !isPowerOfTwo(align) || align%uint64(s.pageSize) != 0 {
+		return nil, fmt.Errorf("alignment %d is not a power-of-two multiple of the page size %d", align, s.pageSize)
+	}
+
+	if a, ok := s.allocator.(AlignedAllocator); ok {
+		return a.AllocateAligned(size, align)
+	}
+	if align == uint64(s.pageSize) {
+		return s.allocator.Allocate(size)
+	}
+	return nil, fmt.Errorf("allocator %T does not support alignment %d", s.allocator, align)
 }
 
-// Free releases allocated space
-func (s *Segment) Free(offset, size uint64) error {
+// AllocateAt claims the exact range starting at offset, e.g. while replaying
+// metadata or importing an existing block file. It fails with an error
+// matching ErrRangeAllocated if any of the range is already allocated.
+// Pre-allocated space is released first and nothing is pre-allocated until
+// the claim is done, so that reservations cannot cause a conflict.
+func (s *Segment) AllocateAt(offset, size uint64) (*Result, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Try to return to pre-allocator first
-	s.preallocator.ReturnSpace(offset, size)
+	if s.allocator == nil {
+		return nil, ErrClosed
+	}
+	c, ok := s.allocator.(ClaimAllocator)
+	if !ok {
+		return nil, fmt.Errorf("allocator %T does not support claiming ranges", s.allocator)
+	}
+	var result *Result
+	err := s.preallocator.WithReleased(func() error {
+		var err error
+		result, err = c.AllocateAt(offset, size)
+		return err
+	})
+	return result, err
+}
+
+// MarkUsed marks the range starting at offset as allocated, like AllocateAt
+func (s *Segment) MarkUsed(offset, size uint64) error {
+	_, err := s.AllocateAt(offset, size)
+	return err
+}
 
-	// Also free from the main allocator
-	s.allocator.Free(uint32(offset), uint32(size))
-	return nil
+// AllocateNear allocates space of the specified size as close to hint as
+// possible, right at it if there is room, where hint is typically the end of
+// the previous extent of the same block file. The pre-allocation pool is
+// bypassed since its blocks are not placed near the hint. Allocators without
+// hint support fall back to Allocate.
+func (s *Segment) AllocateNear(size, hint uint64) (*Result, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.allocator == nil {
+		return nil, ErrClosed
+	}
+	if h, ok := s.allocator.(HintAllocator); ok {
+		return h.AllocateNear(size, hint)
+	}
+	return s.allocator.Allocate(size)
+}
+
+// AllocateStream allocates space of the specified size for a stream, such
+// as a writer or an open block file. Requests are carved in order from a
+// window reserved for the stream, so that consecutive appends to a block
+// file are contiguous even with many concurrent writers.
+func (s *Segment) AllocateStream(stream, size uint64) (*Result, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.allocator == nil {
+		return nil, ErrClosed
+	}
+	offset, length, err := s.preallocator.GetStreamSpace(stream, size)
+	if err != nil {
+		return nil, err
+	}
+	return &Result{
+		Offset: offset,
+		Size:   length,
+	}, nil
+}
+
+// CloseStream releases the unused part of a stream's reserved window, e.g.
+// when its block file is closed
+func (s *Segment) CloseStream(stream uint64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.allocator == nil {
+		return ErrClosed
+	}
+	return s.preallocator.CloseStream(stream)
 }
 
-// GetUtilization returns the current space utilization
+// AllocateVector allocates size bytes as up to maxExtents extents of at
+// least minExtentSize bytes each, so that a block can be written across
+// several physical runs when the segment is too fragmented for one.
+// Allocators without vector support can only return a single extent.
+func (s *Segment) AllocateVector(size uint64, maxExtents int, minExtentSize uint64) (*VectorResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.allocator == nil {
+		return nil, ErrClosed
+	}
+	if v, ok := s.allocator.(VectorAllocator); ok {
+		return v.AllocateVector(size, maxExtents, minExtentSize)
+	}
+
+	result, err := s.allocator.Allocate(size)
+	if err != nil {
+		return nil, err
+	}
+	return &VectorResult{
+		Extents: []Extent{{Offset: result.Offset, Size: result.Size}},
+		Size:    result.Size,
+	}, nil
+}
+
+// Free releases allocated space. Invalid ranges and ranges that are not
+// fully allocated are rejected with the allocator's error and left alone,
+// and so are ranges that overlap pre-allocated space, with ErrDoubleFree.
+// Freed space always goes back to the allocator, whichever path handed it
+// out; the pre-allocator refills its pool from the allocator on its own.
+func (s *Segment) Free(offset, size uint64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.allocator == nil {
+		return ErrClosed
+	}
+	return s.preallocator.Free(offset, size)
+}
+
+// Resize grows or shrinks the segment to newSize, e.g. after the underlying
+// file or LUN was extended. Existing allocations are preserved; a shrink
+// fails with an error matching ErrShrinkBlocked if any allocated space lies
+// past newSize. Pre-allocated space is released first, and stays released
+// until the resize is done, so that reservations cannot block a shrink.
+func (s *Segment) Resize(newSize uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.allocator == nil {
+		return ErrClosed
+	}
+	r, ok := s.allocator.(ResizableAllocator)
+	if !ok {
+		return fmt.Errorf("allocator %T does not support resizing", s.allocator)
+	}
+	return s.preallocator.WithReleased(func() error {
+		return r.Resize(newSize)
+	})
+}
+
+// GetUtilization returns the current space utilization, 0 once closed
 func (s *Segment) GetUtilization() float64 {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
+
+	if s.allocator == nil {
+		return 0
+	}
 	return s.allocator.GetUtilization()
 }
 
-// GetTotalAllocated returns the total allocated space
+// GetTotalAllocated returns the total allocated space, 0 once closed
 func (s *Segment) GetTotalAllocated() uint64 {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
+
+	if s.allocator == nil {
+		return 0
+	}
 	return s.allocator.GetTotalAllocated()
 }
 
-// GetMemoryUsage returns the memory usage of the segment
+// GetMemoryUsage returns the memory usage of the segment, 0 once closed
 func (s *Segment) GetMemoryUsage() uint64 {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
+
+	if s.allocator == nil {
+		return 0
+	}
 	return s.allocator.GetMemoryUsage()
 }
 
-// Close closes the segment and frees all resources
+// GetFragmentation returns statistics about the free extents of the segment.
+// Space held by the pre-allocation pool counts as allocated. A closed
+// segment reports empty statistics.
+func (s *Segment) GetFragmentation() *FragmentationStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.allocator == nil {
+		return &FragmentationStats{}
+	}
+	return GetFragmentation(s.allocator)
+}
+
+// Save writes the allocation state of the segment to w. Pre-allocated space
+// is released first and nothing is pre-allocated until the image is
+// written, so that reservations are not persisted as in use.
+func (s *Segment) Save(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, err := s.persistentAllocator()
+	if err != nil {
+		return err
+	}
+	return s.preallocator.WithReleased(func() error {
+		return p.Save(w)
+	})
+}
+
+// Checkpoint writes the allocation changes since the previous checkpoint
+// to w. Pre-allocated space is released first, as in Save.
+func (s *Segment) Checkpoint(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, err := s.persistentAllocator()
+	if err != nil {
+		return err
+	}
+	return s.preallocator.WithReleased(func() error {
+		return p.Checkpoint(w)
+	})
+}
+
+// SetJournal attaches a write-ahead journal to the segment's allocator
+func (s *Segment) SetJournal(j *Journal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, err := s.persistentAllocator()
+	if err != nil {
+		return err
+	}
+	p.SetJournal(j)
+	return nil
+}
+
+// persistentAllocator returns the allocator if it supports persistence
+func (s *Segment) persistentAllocator() (PersistentAllocator, error) {
+	if s.allocator == nil {
+		return nil, ErrClosed
+	}
+	p, ok := s.allocator.(PersistentAllocator)
+	if !ok {
+		return nil, fmt.Errorf("allocator %T does not support persistence", s.allocator)
+	}
+	return p, nil
+}
+
+// Close closes the segment and frees all resources. It reports pre-allocated
+// space that could not be released; the segment is closed either way.
 func (s *Segment) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.allocator == nil {
+		return ErrClosed
+	}
+
 	// Close preallocator
-	s.preallocator.Close()
+	err := s.preallocator.Close()
 
 	// Reset allocator
 	s.allocator = nil
 	s.preallocator = nil
 
-	return nil
+	return err
 }
 
 // String returns a string representation of the segment
@@ -110,8 +479,11 @@ func (s *Segment) String() string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	if s.allocator == nil {
+		return "Segment(closed)"
+	}
 	return fmt.Sprintf("Segment(utilization=%.2f%%, total_allocated=%d, memory_usage=%d)",
-		s.GetUtilization()*100,
-		s.GetTotalAllocated(),
-		s.GetMemoryUsage())
+		s.allocator.GetUtilization()*100,
+		s.allocator.GetTotalAllocated(),
+		s.allocator.GetMemoryUsage())
 }
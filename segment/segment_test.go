@@ -0,0 +1,488 @@
+package segment
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// modelSegments are the segments the model test runs on
+var modelSegments = []struct {
+	name string
+	size uint64
+	new  func() Allocator
+}{
+	{"bitmap", 256 << 20, func() Allocator { return NewBitmapAllocator() }},
+	{"bitmap-partial-page", 64<<20 - 100, func() Allocator { return NewBitmapAllocator() }},
+	{"extent-first-fit", 256 << 20, func() Allocator { return NewExtentAllocator(FirstFit) }},
+	{"extent-best-fit", 256 << 20, func() Allocator { return NewExtentAllocator(BestFit) }},
+	{"hybrid", 256 << 20, func() Allocator { return NewHybridAllocator(4 << 10) }}, // Spills early
+	{"buddy", 256 << 20, func() Allocator { return NewBuddyAllocator(defaultBuddyMaxBlock) }},
+	{"sharded-4", 256 << 20, func() Allocator { return NewShardedAllocator(4) }},
+	{"sharded-7", 256 << 20, func() Allocator { return NewShardedAllocator(7) }},      // Shorter last shard
+	{"sharded-8-small", 16 << 20, func() Allocator { return NewShardedAllocator(8) }}, // Small shards
+}
+
+// TestSegmentModel runs random Allocate, AllocateStream and Free sequences
+// through a segment with size classes and stream windows, and checks against
+// a model of the live allocations that no two of them ever overlap. Freeing
+// a range again, alone or together with live space, must be rejected, and
+// freeing everything and closing must leave the allocator empty.
+func TestSegmentModel(t *testing.T) {
+	const (
+		operations = 4000
+		streams    = 8
+	)
+	for _, a := range modelSegments {
+		for seed := int64(1); seed <= 3; seed++ {
+			t.Run(fmt.Sprintf("%s/seed=%d", a.name, seed), func(t *testing.T) {
+				rng := rand.New(rand.NewSource(seed))
+				allocator := a.new()
+				seg, err := NewSegmentWithConfig(SegmentConfig{
+					Size:      a.size,
+					Allocator: allocator,
+					SizeClasses: []SizeClass{
+						{Size: 4 << 10, LowWatermark: 16, HighWatermark: 64},
+						{Size: 64 << 10, LowWatermark: 4, HighWatermark: 16},
+					},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				groupSize := a.size
+				if g, ok := allocator.(GroupedAllocator); ok {
+					groupSize = g.GroupSize()
+				}
+				var live []Extent // Live allocations sorted by offset
+				free := func(idx int) {
+					ext := live[idx]
+					if err := seg.Free(ext.Offset, ext.Size); err != nil {
+						t.Fatalf("failed to free [%d, %d): %v", ext.Offset, ext.Offset+ext.Size, err)
+					}
+					live = append(live[:idx], live[idx+1:]...)
+				}
+				freeAgain := func(offset, size uint64) {
+					if err := seg.Free(offset, size); !errors.Is(err, ErrDoubleFree) {
+						t.Fatalf("freeing [%d, %d) again: got %v, want ErrDoubleFree", offset, offset+size, err)
+					}
+				}
+				for i := 0; i < operations; i++ {
+					if len(live) > 0 && rng.Float64() < 0.4 {
+						idx := rng.Intn(len(live))
+						ext := live[idx]
+						free(idx)
+						// Free it again, alone and together with the next live
+						// allocation unless that would cross a group boundary.
+						// The pre-allocator may have reserved it in between.
+						freeAgain(ext.Offset, ext.Size)
+						if idx < len(live) {
+							next := live[idx]
+							if ext.Offset/groupSize == (next.Offset+next.Size-1)/groupSize {
+								freeAgain(ext.Offset, next.Offset+next.Size-ext.Offset)
+							}
+						}
+						continue
+					}
+
+					// Mix the size class sizes with unaligned random ones
+					size := uint64(rng.Int63n(1<<20) + 1)
+					switch rng.Intn(4) {
+					case 0:
+						size = 4 << 10
+					case 1:
+						size = 64 << 10
+					}
+					var res *Result
+					if rng.Intn(4) == 0 {
+						res, err = seg.AllocateStream(uint64(rng.Intn(streams)), size)
+					} else {
+						res, err = seg.Allocate(size)
+					}
+					if errors.Is(err, ErrNoSpace) || errors.Is(err, ErrNoContiguousSpace) {
+						continue
+					}
+					if err != nil {
+						t.Fatalf("operation %d: failed to allocate %d bytes: %v", i, size, err)
+					}
+
+					got := Extent{Offset: res.Offset, Size: res.Size}
+					if got.Size < size || got.Offset+got.Size > a.size {
+						t.Fatalf("operation %d: allocation [%d, %d) for %d bytes is invalid",
+							i, got.Offset, got.Offset+got.Size, size)
+					}
+					idx := sort.Search(len(live), func(j int) bool { return live[j].Offset >= got.Offset })
+					for _, j := range []int{idx - 1, idx} {
+						if j < 0 || j >= len(live) {
+							continue
+						}
+						if other := live[j]; other.Offset < got.Offset+got.Size && got.Offset < other.Offset+other.Size {
+							t.Fatalf("operation %d: allocation [%d, %d) overlaps live allocation [%d, %d)",
+								i, got.Offset, got.Offset+got.Size, other.Offset, other.Offset+other.Size)
+						}
+					}
+					live = append(live, Extent{})
+					copy(live[idx+1:], live[idx:])
+					live[idx] = got
+				}
+
+				for len(live) > 0 {
+					free(len(live) - 1)
+				}
+				if err := seg.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if got := allocator.GetTotalAllocated(); got != 0 {
+					t.Fatalf("%d bytes are still allocated after freeing everything", got)
+				}
+			})
+		}
+	}
+}
+
+// TestSegmentFreePreallocated frees a range again after the pre-allocator
+// has reserved it. The second free must be rejected rather than free space
+// that the pool would hand out again.
+func TestSegmentFreePreallocated(t *testing.T) {
+	allocator := NewBitmapAllocator()
+	seg, err := NewSegmentWithAllocator(64<<20, allocator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Close()
+
+	if err := seg.preallocator.Release(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := allocator.Allocate(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := seg.Free(res.Offset, res.Size); err != nil {
+		t.Fatal(err)
+	}
+	if err := seg.preallocator.checkAndGrow(); err != nil {
+		t.Fatal(err)
+	}
+	if err := seg.Free(res.Offset, res.Size); !errors.Is(err, ErrDoubleFree) {
+		t.Fatalf("freeing pooled [%d, %d): got %v, want ErrDoubleFree", res.Offset, res.Offset+res.Size, err)
+	}
+	if got := allocator.countAllocated(res.Offset/blockSize, res.Size/blockSize); got != res.Size/blockSize {
+		t.Fatalf("%d of %d pooled pages are allocated", got, res.Size/blockSize)
+	}
+}
+
+// TestSegmentStreamAcrossCheckpoint checks that a stream's appends stay
+// contiguous across a checkpoint, which releases its window
+func TestSegmentStreamAcrossCheckpoint(t *testing.T) {
+	seg, err := NewSegment(256 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Close()
+
+	var end uint64
+	for i := 0; i < 4; i++ {
+		res, err := seg.AllocateStream(1, blockSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && res.Offset != end {
+			t.Fatalf("append %d landed at %d, want %d", i, res.Offset, end)
+		}
+		end = res.Offset + res.Size
+		if i == 1 {
+			if err := seg.Checkpoint(io.Discard); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if i == 2 {
+			if err := seg.Save(io.Discard); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// TestSegmentResize shrinks a segment past a claimed range, which must
+// block, then shrinks and grows it again once the range is freed. The pool
+// must not block either resize.
+func TestSegmentResize(t *testing.T) {
+	seg, err := NewSegment(256 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Close()
+
+	claim, err := seg.AllocateAt(192<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = seg.Resize(100 << 20)
+	var blocked *ShrinkBlockedError
+	if !errors.As(err, &blocked) {
+		t.Fatalf("shrinking past a claim: got %v, want a *ShrinkBlockedError", err)
+	}
+	want := Extent{Offset: claim.Offset, Size: claim.Size}
+	if len(blocked.Blocking) != 1 || blocked.Blocking[0] != want || blocked.BlockingBytes != claim.Size {
+		t.Fatalf("blocking %v with %d bytes, want [%v] with %d bytes",
+			blocked.Blocking, blocked.BlockingBytes, want, claim.Size)
+	}
+
+	if err := seg.Free(claim.Offset, claim.Size); err != nil {
+		t.Fatal(err)
+	}
+	if err := seg.Resize(100 << 20); err != nil {
+		t.Fatalf("shrinking to 100 MiB: %v", err)
+	}
+	if _, err := seg.AllocateAt(192<<20, 1<<20); !errors.Is(err, ErrOutOfRange) {
+		t.Fatalf("claiming past the shrunk end: got %v, want ErrOutOfRange", err)
+	}
+	if err := seg.Resize(256 << 20); err != nil {
+		t.Fatalf("growing to 256 MiB: %v", err)
+	}
+	if _, err := seg.AllocateAt(192<<20, 1<<20); err != nil {
+		t.Fatalf("claiming in the grown space: %v", err)
+	}
+}
+
+// TestSegmentBeyond4GiB claims, allocates and frees ranges past 4 GiB on a
+// maxDiskSize segment, checking that every range is freed where it was
+// handed out
+func TestSegmentBeyond4GiB(t *testing.T) {
+	const gib = 1 << 30
+	allocator := NewBitmapAllocator()
+	seg, err := NewSegmentWithAllocator(maxDiskSize, allocator)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := []Extent{
+		{Offset: 4 * gib, Size: 1 << 20},
+		{Offset: 16 * gib, Size: 8 * gib},
+		{Offset: maxDiskSize - 1<<20, Size: 1 << 20},
+	}
+	var results []Extent
+	for _, c := range claims {
+		res, err := seg.AllocateAt(c.Offset, c.Size)
+		if err != nil {
+			t.Fatalf("failed to claim [%d, %d): %v", c.Offset, c.Offset+c.Size, err)
+		}
+		if res.Offset != c.Offset || res.Size != c.Size {
+			t.Fatalf("claim of [%d, %d) returned [%d, %d)", c.Offset, c.Offset+c.Size, res.Offset, res.Offset+res.Size)
+		}
+		results = append(results, c)
+	}
+	for _, size := range []uint64{5 * gib, 3 << 20, 64 << 10} {
+		res, err := seg.Allocate(size)
+		if err != nil {
+			t.Fatalf("failed to allocate %d bytes: %v", size, err)
+		}
+		if res.Size != size || res.Offset+res.Size > maxDiskSize {
+			t.Fatalf("allocation of %d bytes returned [%d, %d)", size, res.Offset, res.Offset+res.Size)
+		}
+		results = append(results, Extent{Offset: res.Offset, Size: res.Size})
+	}
+	res, err := seg.AllocateNear(1<<20, 700*gib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Offset != 700*gib {
+		t.Fatalf("allocation near %d returned %d", uint64(700*gib), res.Offset)
+	}
+	results = append(results, Extent{Offset: res.Offset, Size: res.Size})
+
+	for _, r := range results {
+		if err := seg.Free(r.Offset, r.Size); err != nil {
+			t.Fatalf("failed to free [%d, %d): %v", r.Offset, r.Offset+r.Size, err)
+		}
+	}
+
+	// The claimed ranges are free again
+	for _, c := range claims {
+		if _, err := seg.AllocateAt(c.Offset, c.Size); err != nil {
+			t.Fatalf("failed to claim [%d, %d) after freeing it: %v", c.Offset, c.Offset+c.Size, err)
+		}
+		if err := seg.Free(c.Offset, c.Size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := seg.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := allocator.GetTotalAllocated(); got != 0 {
+		t.Fatalf("%d bytes are still allocated after freeing everything", got)
+	}
+}
+
+// TestSegmentShardedSkipsPool checks that a segment over a sharded allocator
+// serves plain allocations from the shards rather than from a shared pool,
+// and that the sharded allocator fails cleanly before Init
+func TestSegmentShardedSkipsPool(t *testing.T) {
+	uninit := NewShardedAllocator(4)
+	if _, err := uninit.Allocate(blockSize); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("allocating before Init: got %v, want ErrNoSpace", err)
+	}
+	if _, err := uninit.AllocateStream(3, blockSize); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("allocating a stream before Init: got %v, want ErrNoSpace", err)
+	}
+	if err := uninit.Free(0, blockSize); !errors.Is(err, ErrOutOfRange) {
+		t.Fatalf("freeing before Init: got %v, want ErrOutOfRange", err)
+	}
+
+	allocator := NewShardedAllocator(4)
+	seg, err := NewSegmentWithAllocator(256<<20, allocator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Close()
+	if got := allocator.GetTotalAllocated(); got != 0 {
+		t.Fatalf("%d bytes are pre-allocated from a sharded allocator", got)
+	}
+	res, err := seg.Allocate(64 << 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := seg.Free(res.Offset, res.Size); err != nil {
+		t.Fatal(err)
+	}
+	if got := allocator.GetTotalAllocated(); got != 0 {
+		t.Fatalf("%d bytes are still allocated after freeing everything", got)
+	}
+}
+
+// BenchmarkSegmentParallel allocates and frees 64 KiB through a segment from
+// parallel writers, each either calling Allocate or appending to its own
+// stream
+func BenchmarkSegmentParallel(b *testing.B) {
+	allocators := []struct {
+		name string
+		new  func() Allocator
+	}{
+		{"bitmap", func() Allocator { return NewBitmapAllocator() }},
+		{"sharded", func() Allocator { return NewShardedAllocator(0) }},
+	}
+	for _, a := range allocators {
+		for _, stream := range []bool{false, true} {
+			b.Run(fmt.Sprintf("%s/stream=%t", a.name, stream), func(b *testing.B) {
+				seg, err := NewSegmentWithAllocator(16<<30, a.new())
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer seg.Close()
+
+				var writers atomic.Uint64
+				b.SetParallelism(4)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					id := writers.Add(1)
+					for pb.Next() {
+						var res *Result
+						var err error
+						if stream {
+							res, err = seg.AllocateStream(id, 64<<10)
+						} else {
+							res, err = seg.Allocate(64 << 10)
+						}
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						if err := seg.Free(res.Offset, res.Size); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+// TestSpaceErrorLargestFree fragments allocators at random and checks that
+// failed allocations report the largest free extent at the failure, for
+// requests that exceed it and requests that exceed all free space
+func TestSpaceErrorLargestFree(t *testing.T) {
+	for _, a := range modelSegments {
+		if strings.HasPrefix(a.name, "buddy") || strings.HasPrefix(a.name, "sharded") {
+			// Their free extents coalesce across blocks and shards that
+			// cannot serve one allocation
+			continue
+		}
+		t.Run(a.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			allocator := a.new()
+			allocator.Init(a.size, blockSize)
+			var live []*Result
+			for {
+				res, err := allocator.Allocate(uint64(rng.Int63n(1<<20) + 1))
+				if err != nil {
+					break
+				}
+				live = append(live, res)
+			}
+			for _, res := range live {
+				if rng.Intn(3) == 0 {
+					if err := allocator.Free(res.Offset, res.Size); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			stats := GetFragmentation(allocator)
+			for _, size := range []uint64{stats.LargestFree + blockSize, stats.FreeBytes + blockSize} {
+				_, err := allocator.Allocate(size)
+				var spaceErr *SpaceError
+				if !errors.As(err, &spaceErr) {
+					t.Fatalf("allocating %d bytes: got %v, want a *SpaceError", size, err)
+				}
+				if spaceErr.LargestFree != stats.LargestFree {
+					t.Fatalf("allocating %d bytes: got %v, want a largest free extent of %d bytes",
+						size, err, stats.LargestFree)
+				}
+			}
+		})
+	}
+}
+
+// TestFreeOutOfRange checks that every allocator rejects frees reaching past
+// its space without touching anything, however long the range, even when its
+// length wraps around as it is rounded up to whole pages. Allocations that
+// long must fail too.
+func TestFreeOutOfRange(t *testing.T) {
+	for _, a := range modelSegments {
+		t.Run(a.name, func(t *testing.T) {
+			allocator := a.new()
+			allocator.Init(a.size, blockSize)
+			res, err := allocator.Allocate(1 << 20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range []Extent{
+				{Offset: 0, Size: 1 << 46},
+				{Offset: res.Offset + blockSize, Size: a.size},
+				{Offset: bitmapAlign(a.size, blockSize) - blockSize, Size: 2 * blockSize},
+				{Offset: res.Offset, Size: ^uint64(0)},
+				{Offset: res.Offset, Size: ^uint64(0) - blockSize + 2},
+			} {
+				if err := allocator.Free(r.Offset, r.Size); !errors.Is(err, ErrOutOfRange) {
+					t.Fatalf("freeing [%d, %d): got %v, want ErrOutOfRange", r.Offset, r.Offset+r.Size, err)
+				}
+			}
+			for _, size := range []uint64{^uint64(0), ^uint64(0) - blockSize + 2} {
+				var spaceErr *SpaceError
+				if got, err := allocator.Allocate(size); !errors.As(err, &spaceErr) {
+					t.Fatalf("allocating %d bytes: got %v, %v, want a *SpaceError", size, got, err)
+				}
+			}
+			if got := allocator.GetTotalAllocated(); got != res.Size {
+				t.Fatalf("%d bytes are allocated after rejected requests, want %d", got, res.Size)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package segment
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+)
+
+// ShardedAllocator splits the space into independently locked bitmap shards
+// (allocation groups) so that concurrent writers do not serialize on one
+// lock. An allocation is served from one shard: the caller's home shard
+// first, then the other shards in order.
+type ShardedAllocator struct {
+	shards    []*BitmapAllocator // Shards in offset order
+	shardSize uint64             // Size of every shard except possibly the last
+	numShards int                // Requested number of shards
+	totalSize uint64             // Total size of managed space
+	next      atomic.Uint64      // Round-robin home shard for Allocate
+}
+
+// NewShardedAllocator creates a new sharded allocator with numShards shards,
+// or one per CPU if numShards is not positive
+func NewShardedAllocator(numShards int) *ShardedAllocator {
+	if numShards <= 0 {
+		numShards = runtime.GOMAXPROCS(0)
+	}
+	return &ShardedAllocator{numShards: numShards}
+}
+
+// Init initializes the sharded allocator with the specified size. Shards are
+// a whole number of unit sets so that none shares a level1 word boundary.
+func (s *ShardedAllocator) Init(size uint64, pageSize uint32) {
+	s.totalSize = size
+	unit := uint64(pageSize) * bitsPerUnitSet
+	s.shardSize = bitmapRoundup((size+uint64(s.numShards)-1)/uint64(s.numShards), unit)
+	if s.shardSize == 0 {
+		s.shardSize = unit
+	}
+
+	s.shards = s.shards[:0]
+	for base := uint64(0); base < size || len(s.shards) == 0; base += s.shardSize {
+		shard := NewBitmapAllocator()
+		shard.Init(min(s.shardSize, size-base), pageSize)
+		s.shards = append(s.shards, shard)
+	}
+}
+
+// NumShards returns the number of shards
+func (s *ShardedAllocator) NumShards() int {
+	return len(s.shards)
+}
+
+// GroupSize returns the size of a shard, the last one may be smaller
+func (s *ShardedAllocator) GroupSize() uint64 {
+	return s.shardSize
+}
+
+// Allocate allocates space of the specified size, spreading callers over
+// the shards round-robin
+func (s *ShardedAllocator) Allocate(size uint64) (*Result, error) {
+	return s.allocateFrom(s.next.Add(1), size)
+}
+
+// AllocateStream allocates space of the specified size from the home shard
+// of a stream, stealing from the other shards when it is full. Writers that
+// use their own stream IDs mostly take disjoint locks.
+func (s *ShardedAllocator) AllocateStream(stream, size uint64) (*Result, error) {
+	return s.allocateFrom(stream, size)
+}
+
+// allocateFrom tries the home shard, key modulo the number of shards, first
+// and then steals from the others. Before Init there are no shards and no
+// space.
+func (s *ShardedAllocator) allocateFrom(key, size uint64) (*Result, error) {
+	if size == 0 {
+		return nil, ErrZeroSize
+	}
+	if len(s.shards) == 0 {
+		return nil, newSpaceError(size, 0, 0)
+	}
+	home := int(key % uint64(len(s.shards)))
+
+	var free, largest uint64
+	for i := range s.shards {
+		idx := (home + i) % len(s.shards)
+		result, err := s.shards[idx].Allocate(size)
+		if err == nil {
+			result.Offset += uint64(idx) * s.shardSize
+			return result, nil
+		}
+		var spaceErr *SpaceError
+		if !errors.As(err, &spaceErr) {
+			return nil, err
+		}
+		free += spaceErr.Free
+		largest = max(largest, spaceErr.LargestFree)
+	}
+	return nil, newSpaceError(bitmapRoundup(size, uint64(s.shards[0].pageSize)), free, largest)
+}
+
+// Free releases allocated space. The range must lie within one shard.
+func (s *ShardedAllocator) Free(offset, size uint64) error {
+	if len(s.shards) == 0 || offset/s.shardSize >= uint64(len(s.shards)) {
+		return fmt.Errorf("%w: [%d, %d)", ErrOutOfRange, offset, offset+size)
+	}
+	idx := offset / s.shardSize
+	if err := s.shards[idx].Free(offset-idx*s.shardSize, size); err != nil {
+		return fmt.Errorf("shard %d: %w", idx, err)
+	}
+	return nil
+}
+
+// GetUtilization returns the current space utilization
+func (s *ShardedAllocator) GetUtilization() float64 {
+	if s.totalSize == 0 {
+		return 0
+	}
+	return float64(s.GetTotalAllocated()) / float64(s.totalSize)
+}
+
+// GetTotalAllocated returns the total allocated space
+func (s *ShardedAllocator) GetTotalAllocated() uint64 {
+	var total uint64
+	for _, shard := range s.shards {
+		total += shard.GetTotalAllocated()
+	}
+	return total
+}
+
+// GetMemoryUsage returns the memory usage of the allocator
+func (s *ShardedAllocator) GetMemoryUsage() uint64 {
+	var total uint64
+	for _, shard := range s.shards {
+		total += shard.GetMemoryUsage()
+	}
+	return total
+}
+
+// ForEachFreeExtent calls fn for each maximal free extent in offset order
+// until fn returns false. Free extents touching at a shard boundary are
+// reported as one. fn is called under the lock of one shard at a time and
+// must not call the allocator.
+func (s *ShardedAllocator) ForEachFreeExtent(fn func(offset, length uint64) bool) {
+	var pendingOffset, pendingLength uint64
+	for idx, shard := range s.shards {
+		base := uint64(idx) * s.shardSize
+		stopped := false
+		shard.ForEachFreeExtent(func(offset, length uint64) bool {
+			offset += base
+			if pendingLength > 0 && pendingOffset+pendingLength == offset {
+				pendingLength += length
+				return true
+			}
+			if pendingLength > 0 && !fn(pendingOffset, pendingLength) {
+				stopped = true
+				return false
+			}
+			pendingOffset, pendingLength = offset, length
+			return true
+		})
+		if stopped {
+			return
+		}
+	}
+	if pendingLength > 0 {
+		fn(pendingOffset, pendingLength)
+	}
+}